@@ -71,7 +71,7 @@ func main() {
 	if zpuConfig.StartUpDelay > 0 {
 		randmonSleepInterval := rand.Intn(zpuConfig.StartUpDelay)
 		log.Printf("Launching zpe_policy_updater in %v seconds", randmonSleepInterval)
-		time.Sleep(time.Duration(randmonSleepInterval) * time.Second)
+		zpuConfig.GetClock().Sleep(time.Duration(randmonSleepInterval) * time.Second)
 	} else {
 		log.Println("Launching zpe_policy_updater without delay")
 	}
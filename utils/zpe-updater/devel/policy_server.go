@@ -0,0 +1,177 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package devel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/libs/go/zmssvctoken"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// PolicySigner signs policy data the way zts and zms do, with the private
+// key in PEM format for both signatures
+type PolicySigner struct {
+	PrivateKey string
+	ZtsKeyId   string
+	ZmsKeyId   string
+}
+
+// Sign returns the signed policy data of the domain with a single policy
+// granting the domain admin role every action on the domain resources
+func (signer *PolicySigner) Sign(domain string, modified, expires time.Time) (*zts.DomainSignedPolicyData, error) {
+	effect := zts.ALLOW
+	return signer.SignPolicies(&zts.PolicyData{
+		Domain: zts.DomainName(domain),
+		Policies: []*zts.Policy{
+			&zts.Policy{
+				Name: zts.ResourceName(domain + ":policy.admin"),
+				Assertions: []*zts.Assertion{
+					&zts.Assertion{
+						Role:     domain + ":role.admin",
+						Resource: domain + ":*",
+						Action:   "*",
+						Effect:   &effect,
+					},
+				},
+			},
+		},
+	}, modified, expires)
+}
+
+// SignPolicies returns the given policy data signed by zms and zts
+func (signer *PolicySigner) SignPolicies(policyData *zts.PolicyData, modified, expires time.Time) (*zts.DomainSignedPolicyData, error) {
+	keySigner, err := zmssvctoken.NewSigner([]byte(signer.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	input, err := util.ToCanonicalString(policyData)
+	if err != nil {
+		return nil, err
+	}
+	zmsSignature, err := keySigner.Sign(input)
+	if err != nil {
+		return nil, err
+	}
+	signedPolicyData := &zts.SignedPolicyData{
+		PolicyData:   policyData,
+		ZmsSignature: zmsSignature,
+		ZmsKeyId:     signer.ZmsKeyId,
+		Modified:     rdl.NewTimestamp(modified),
+		Expires:      rdl.NewTimestamp(expires),
+	}
+	input, err = util.ToCanonicalString(signedPolicyData)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := keySigner.Sign(input)
+	if err != nil {
+		return nil, err
+	}
+	return &zts.DomainSignedPolicyData{
+		SignedPolicyData: signedPolicyData,
+		Signature:        signature,
+		KeyId:            signer.ZtsKeyId,
+	}, nil
+}
+
+// PolicyServer is a fake zts and zms. It serves the signed policy data of
+// its domains, with etags from their modified time, and the public key for
+// every zts and zms key id. The server url is used as both the Zts and the
+// Zms of a configuration, which must set AllowInsecureHTTP since the server
+// is plaintext.
+type PolicyServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	publicKey string
+	policies  map[string]*zts.DomainSignedPolicyData
+	requests  []string
+}
+
+// StartPolicyServer starts a PolicyServer serving the policies with the
+// public key in PEM format, the caller closes it
+func StartPolicyServer(publicKey string, policies map[string]*zts.DomainSignedPolicyData) *PolicyServer {
+	server := &PolicyServer{publicKey: publicKey, policies: make(map[string]*zts.DomainSignedPolicyData)}
+	for domain, data := range policies {
+		server.policies[domain] = data
+	}
+	server.Server = httptest.NewServer(server)
+	return server
+}
+
+// SetPolicies replaces the policy data served for the domain, nil stops
+// serving the domain
+func (server *PolicyServer) SetPolicies(domain string, data *zts.DomainSignedPolicyData) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	if data == nil {
+		delete(server.policies, domain)
+		return
+	}
+	server.policies[domain] = data
+}
+
+// RequestedDomains returns the domains whose policy data was requested, in
+// request order
+func (server *PolicyServer) RequestedDomains() []string {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]string{}, server.requests...)
+}
+
+// Reset forgets the requested domains
+func (server *PolicyServer) Reset() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	server.requests = nil
+}
+
+// ServeHTTP answers the policy data and public key requests, so that a test
+// server can serve other requests and hand these to the PolicyServer
+func (server *PolicyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/zms/v1/domain/sys.auth/service/") {
+		server.handlePublicKey(w, r)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/zts/v1/domain/")
+	if !strings.HasSuffix(path, "/signed_policy_data") {
+		http.NotFound(w, r)
+		return
+	}
+	domain := strings.TrimSuffix(path, "/signed_policy_data")
+	server.mutex.Lock()
+	server.requests = append(server.requests, domain)
+	data := server.policies[domain]
+	server.mutex.Unlock()
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	etag := "\"" + data.SignedPolicyData.Modified.String() + "\""
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (server *PolicyServer) handlePublicKey(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/zms/v1/domain/sys.auth/service/"), "/")
+	if len(parts) != 3 || parts[1] != "publickey" || (parts[0] != "zts" && parts[0] != "zms") {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: parts[2], Key: new(zmssvctoken.YBase64).EncodeToString([]byte(server.publicKey))})
+}
@@ -0,0 +1,84 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package devel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func generateKeyPair(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	der, err = x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	publicKey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return string(privateKey), string(publicKey)
+}
+
+func TestPolicyServer(t *testing.T) {
+	a := assert.New(t)
+	privateKey, publicKey := generateKeyPair(t)
+	signer := &PolicySigner{PrivateKey: privateKey, ZtsKeyId: "zts.test", ZmsKeyId: "zms.test"}
+	now := time.Now()
+	data, err := signer.Sign("harness", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := StartPolicyServer(publicKey, map[string]*zts.DomainSignedPolicyData{"harness": data})
+	defer server.Close()
+
+	policyDir, err := ioutil.TempDir("", "zpu_harness")
+	require.Nil(t, err)
+	defer os.RemoveAll(policyDir)
+	tmpDir, err := ioutil.TempDir("", "zpu_harness_tmp")
+	require.Nil(t, err)
+	defer os.RemoveAll(tmpDir)
+	config := &zpu.ZpuConfiguration{
+		Zts:              server.URL,
+		Zms:              server.URL,
+		DomainList:       "harness,missing",
+		PolicyFileDir:    policyDir,
+		TmpPolicyFileDir: tmpDir,
+		//the policy server is plaintext
+		AllowInsecureHTTP: true,
+	}
+	result, err := zpu.UpdatePolicies(config)
+	a.NotNil(err, "Domains without policies are not served")
+	require.NotNil(t, result)
+	a.Equal([]string{"harness"}, result.UpdatedDomains, "The signed policies are accepted with the served public keys")
+	a.Equal([]string{"missing"}, result.FailedDomains)
+	a.True(util.Exists(policyDir + "/harness.pol"))
+
+	//the stored policy is sent as the etag of the next fetch
+	result, err = zpu.UpdatePolicies(config)
+	require.NotNil(t, result)
+	a.Equal([]string{"harness"}, result.NotModifiedDomains)
+	a.Equal([]string{"harness", "missing", "harness", "missing"}, server.RequestedDomains())
+	server.Reset()
+	a.Empty(server.RequestedDomains())
+
+	otherKey, _ := generateKeyPair(t)
+	otherSigner := &PolicySigner{PrivateKey: otherKey, ZtsKeyId: "zts.test", ZmsKeyId: "zms.test"}
+	forged, err := otherSigner.Sign("missing", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server.SetPolicies("missing", forged)
+	result, err = zpu.UpdatePolicies(config)
+	require.NotNil(t, result)
+	a.Equal([]string{"missing"}, result.FailedDomains, "Policies signed with another key are rejected")
+}
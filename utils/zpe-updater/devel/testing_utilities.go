@@ -22,7 +22,7 @@ func StartMockServer(endPoints map[string]string, metricEndPoints []string) stri
 
 	for key, val := range endPoints {
 		router.HandleFunc(key, func(w http.ResponseWriter, r *http.Request) {
-
+			w.Header().Set("Content-Type", "application/json")
 			io.WriteString(w, string(val))
 		}).Methods("GET")
 	}
@@ -33,6 +33,7 @@ func StartMockServer(endPoints map[string]string, metricEndPoints []string) stri
 				log.Fatalf("Could not read the body, error: %v", err)
 			}
 
+			w.Header().Set("Content-Type", "application/json")
 			io.WriteString(w, string(body))
 		}).Methods("POST")
 	}
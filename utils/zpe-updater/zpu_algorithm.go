@@ -0,0 +1,182 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// AlgorithmDowngradeError is reported when the policies of a domain are
+// signed with a weaker algorithm than the strongest one seen for the domain
+type AlgorithmDowngradeError struct {
+	Domain   string
+	Signer   string
+	Previous string
+	Current  string
+}
+
+func (e *AlgorithmDowngradeError) Error() string {
+	return fmt.Sprintf("Signature algorithm of the %v signature of domain: %v downgraded from %v to %v", e.Signer, e.Domain, e.Previous, e.Current)
+}
+
+// signatureAlgorithmOf returns the algorithm of the signatures verified with
+// the public key with the strength of the key, such as RSA-2048-SHA256 or
+// ECDSA-P256-SHA256, tests replace it to report other algorithms
+var signatureAlgorithmOf = func(publicKey string) (string, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return "", errors.New("Unable to load public key")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	//zmssvctoken signs and verifies with sha256 only
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d-SHA256", key.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA-P%d-SHA256", key.Curve.Params().BitSize), nil
+	default:
+		return "", errors.New("Unsupported key type, not RSA or ECDSA")
+	}
+}
+
+// algorithmStrength ranks an algorithm by its security bits, the lower of
+// its hash and of its key size when known, 0 when unknown
+func algorithmStrength(algorithm string) int {
+	parts := strings.Split(algorithm, "-")
+	strength := hashStrength(parts[len(parts)-1])
+	if strength == 0 || len(parts) != 3 {
+		return strength
+	}
+	keyStrength := 0
+	switch parts[0] {
+	case "RSA":
+		keyStrength = rsaStrength(parts[1])
+	case "ECDSA":
+		keyStrength = ecdsaStrength(parts[1])
+	}
+	if keyStrength < strength {
+		return keyStrength
+	}
+	return strength
+}
+
+func hashStrength(hash string) int {
+	switch hash {
+	case "SHA1":
+		return 80
+	case "SHA256":
+		return 128
+	case "SHA384":
+		return 192
+	case "SHA512":
+		return 256
+	}
+	return 0
+}
+
+// rsaStrength returns the security bits of an RSA key of the size
+func rsaStrength(size string) int {
+	bits, err := strconv.Atoi(size)
+	switch {
+	case err != nil:
+		return 0
+	case bits >= 15360:
+		return 256
+	case bits >= 7680:
+		return 192
+	case bits >= 3072:
+		return 128
+	case bits >= 2048:
+		return 112
+	case bits >= 1024:
+		return 80
+	}
+	return 40
+}
+
+// ecdsaStrength returns the security bits of an ECDSA key on the curve
+func ecdsaStrength(curve string) int {
+	switch curve {
+	case "P224":
+		return 112
+	case "P256":
+		return 128
+	case "P384":
+		return 192
+	case "P521":
+		return 256
+	}
+	return 0
+}
+
+func algorithmFile(policyFile string) string {
+	return policyFile + ".alg"
+}
+
+// checkAlgorithmDowngrade warns when the zts or zms signature of the policies
+// uses a weaker algorithm than recorded for the domain, the algorithms are
+// those of the keys the signatures verified with. The strongest algorithm
+// seen for each signer is kept next to the policy file, unless record is
+// false.
+func checkAlgorithmDowngrade(config *ZpuConfiguration, keys *signerKeys, domain, policyFileDir string, record bool) {
+	sidecar := algorithmFile(config.policyFile(policyFileDir, domain))
+	seen := map[string]string{}
+	if util.Exists(sidecar) {
+		bytes, err := ioutil.ReadFile(sidecar)
+		if err == nil {
+			err = json.Unmarshal(bytes, &seen)
+		}
+		if err != nil {
+			log.Printf("Unable to read signature algorithms of domain: %v, Error:%v", domain, err)
+			seen = map[string]string{}
+		}
+	}
+	publicKeys := map[string]string{"zts": keys.zts, "zms": keys.zms}
+	changed := false
+	for _, signer := range []string{"zts", "zms"} {
+		algorithm, err := signatureAlgorithmOf(publicKeys[signer])
+		if err != nil {
+			log.Printf("Unable to determine the %v signature algorithm of domain: %v, Error:%v", signer, domain, err)
+			continue
+		}
+		previous := seen[signer]
+		if previous != "" && algorithmStrength(algorithm) < algorithmStrength(previous) {
+			log.Printf("Warning: %v", &AlgorithmDowngradeError{Domain: domain, Signer: signer, Previous: previous, Current: algorithm})
+			continue
+		}
+		if algorithm != previous {
+			seen[signer] = algorithm
+			changed = true
+		}
+	}
+	if !changed || !record {
+		return
+	}
+	bytes, err := json.Marshal(seen)
+	if err == nil {
+		err = ioutil.WriteFile(sidecar+".tmp", bytes, 0644)
+	}
+	if err == nil {
+		err = os.Rename(sidecar+".tmp", sidecar)
+	}
+	if err != nil {
+		log.Printf("Unable to record signature algorithms of domain: %v, Error:%v", domain, err)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestSignatureAlgorithmOf(t *testing.T) {
+	a := assert.New(t)
+	algorithm, err := signatureAlgorithmOf(testPublicKey)
+	a.Nil(err)
+	a.Equal("RSA-2048-SHA256", algorithm)
+	_, err = signatureAlgorithmOf("not a key")
+	a.NotNil(err)
+	a.True(algorithmStrength("RSA-SHA1") < algorithmStrength("RSA-SHA256"))
+	a.Equal(0, algorithmStrength("unknown"))
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.Nil(t, err)
+	algorithm, err = signatureAlgorithmOf(encodePublicKey(t, &rsaKey.PublicKey))
+	a.Nil(err)
+	a.Equal("RSA-1024-SHA256", algorithm)
+	a.True(algorithmStrength(algorithm) < algorithmStrength("RSA-2048-SHA256"), "A smaller key is a downgrade")
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	algorithm, err = signatureAlgorithmOf(encodePublicKey(t, &ecKey.PublicKey))
+	a.Nil(err)
+	a.Equal("ECDSA-P384-SHA256", algorithm)
+	a.Equal(128, algorithmStrength(algorithm), "The sha256 hash bounds the strength of the key")
+	a.True(algorithmStrength("RSA-2048-SHA256") < algorithmStrength("ECDSA-P256-SHA256"))
+}
+
+func encodePublicKey(t *testing.T, key interface{}) string {
+	bytes, err := x509.MarshalPKIXPublicKey(key)
+	require.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bytes}))
+}
+
+func TestDetectAlgorithmDowngrade(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("downgrade", now.Add(-time.Hour), now.Add(time.Hour))
+	require.Nil(t, err)
+	changed, err := signPolicyData("downgrade", now.Add(-time.Minute), now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"downgrade": data})
+	defer server.Close()
+	defer removePolicyFiles("downgrade")
+	sidecar := algorithmFile(POLICIES_DIR + "/downgrade.pol")
+	defer os.Remove(sidecar)
+	removePolicyFiles("downgrade")
+	os.Remove(sidecar)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := getServerConfiguration(server, "downgrade")
+	config.DetectAlgorithmDowngrade = true
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "downgraded"))
+	recorded, err := ioutil.ReadFile(sidecar)
+	a.Nil(err)
+	a.Equal(`{"zms":"RSA-2048-SHA256","zts":"RSA-2048-SHA256"}`, string(recorded))
+
+	defer func(original func(string) (string, error)) { signatureAlgorithmOf = original }(signatureAlgorithmOf)
+	signatureAlgorithmOf = func(publicKey string) (string, error) {
+		return "RSA-SHA1", nil
+	}
+	server.SetPolicies("downgrade", changed)
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.True(strings.Contains(logs.String(), "Warning: Signature algorithm of the zts signature of domain: downgrade downgraded from RSA-2048-SHA256 to RSA-SHA1"))
+	recorded, err = ioutil.ReadFile(sidecar)
+	a.Nil(err)
+	a.Equal(`{"zms":"RSA-2048-SHA256","zts":"RSA-2048-SHA256"}`, string(recorded), "The strongest algorithm stays recorded")
+}
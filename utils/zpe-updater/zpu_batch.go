@@ -0,0 +1,181 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// fsyncBatch collects the temporary policy files written during a run so
+// that their contents are synced concurrently at the end of the run and the
+// directories are synced once instead of once per file. Every policy file
+// is still moved into place with its own rename.
+type fsyncBatch struct {
+	files []batchedPolicyFile
+}
+
+type batchedPolicyFile struct {
+	domain         string
+	tempPolicyFile string
+	policyFileDir  string
+	// backupFile is the copy of the previous policy file kept for
+	// VerifyAfterWrite, "" when there is none
+	backupFile string
+	// modified is set when the PostValidateTransform changed the policies
+	modified bool
+	// data and etag, the one returned by zts, are kept for the etag file and
+	// the OPA data document
+	data *zts.DomainSignedPolicyData
+	etag string
+}
+
+func (batch *fsyncBatch) stage(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain, policyFileDir string, modified bool, etag string) error {
+	if config.tmpPolicyDir() == "" || data == nil {
+		return errors.New("Empty parameters are not valid arguments")
+	}
+	backupFile := ""
+	if config.VerifyAfterWrite {
+		var err error
+		policyFile := config.policyFile(policyFileDir, domain)
+		backupFile, err = backupPolicyFile(config, domain, policyFile)
+		if err != nil {
+			return err
+		}
+	}
+	tempPolicyFile, err := writeTempPolicyFile(config, data, domain, false)
+	if err != nil {
+		if backupFile != "" {
+			os.Remove(backupFile)
+		}
+		return err
+	}
+	batch.files = append(batch.files, batchedPolicyFile{
+		domain:         domain,
+		tempPolicyFile: tempPolicyFile,
+		policyFileDir:  policyFileDir,
+		backupFile:     backupFile,
+		modified:       modified,
+		data:           data,
+		etag:           etag,
+	})
+	return nil
+}
+
+// staged reports whether the policy file of the domain is staged, a nil
+// batch stages nothing
+func (batch *fsyncBatch) staged(domain string) bool {
+	if batch == nil {
+		return false
+	}
+	for _, file := range batch.files {
+		if file.domain == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// commit syncs the staged files and the temporary directory, renames every
+// staged file into place and syncs the policy directories, returning the
+// errors of failed domains. With VerifyAfterWrite every committed file is
+// read back and validated.
+func (batch *fsyncBatch) commit(config *ZpuConfiguration, zmsClient zms.ZMSClient) map[string]error {
+	errs := batch.syncFiles()
+	if len(batch.files) == len(errs) {
+		return errs
+	}
+	err := syncDir(config.tmpPolicyDir())
+	if err != nil {
+		for _, file := range batch.files {
+			if _, failed := errs[file.domain]; failed {
+				continue
+			}
+			errs[file.domain] = fmt.Errorf("Unable to sync temporary policy directory, Error:%v", err)
+			file.discard()
+		}
+		return errs
+	}
+	synced := make(map[string]error)
+	for _, file := range batch.files {
+		if _, failed := errs[file.domain]; failed {
+			continue
+		}
+		policyFile := config.policyFile(file.policyFileDir, file.domain)
+		err = movePolicyFile(config, file.tempPolicyFile, policyFile)
+		if err != nil {
+			errs[file.domain] = err
+			file.discard()
+			continue
+		}
+		synced[file.policyFileDir] = nil
+	}
+	for dir := range synced {
+		synced[dir] = syncDir(dir)
+	}
+	for _, file := range batch.files {
+		if _, failed := errs[file.domain]; failed {
+			continue
+		}
+		if err := synced[file.policyFileDir]; err != nil {
+			errs[file.domain] = fmt.Errorf("Unable to sync policy directory: %v, Error:%v", file.policyFileDir, err)
+			continue
+		}
+		policyFile := config.policyFile(file.policyFileDir, file.domain)
+		if config.VerifyAfterWrite {
+			err = verifyWrittenPolicyFile(config, zmsClient, policyFile, file.backupFile, file.modified)
+			if err != nil {
+				errs[file.domain] = err
+				continue
+			}
+		}
+		err = updateModifiedMarker(policyFile, file.modified)
+		if err == nil && config.StoreServerEtag {
+			err = updateServerEtag(config, file.data, file.domain, policyFile, file.etag)
+		}
+		if err == nil && config.OpaDataDir != "" {
+			err = writeOpaData(config, file.data, file.domain)
+		}
+		if err != nil {
+			errs[file.domain] = err
+		}
+	}
+	return errs
+}
+
+// syncFiles syncs the contents of every staged file concurrently, the
+// domains whose file cannot be synced are failed and their files discarded
+func (batch *fsyncBatch) syncFiles() map[string]error {
+	errs := make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for _, file := range batch.files {
+		wg.Add(1)
+		go func(file batchedPolicyFile) {
+			defer wg.Done()
+			err := syncPath(file.tempPolicyFile)
+			if err != nil {
+				file.discard()
+				mutex.Lock()
+				errs[file.domain] = fmt.Errorf("Unable to sync temporary policy file: %v, Error:%v", file.tempPolicyFile, err)
+				mutex.Unlock()
+			}
+		}(file)
+	}
+	wg.Wait()
+	return errs
+}
+
+// discard removes the temporary and backup files of a domain that failed
+func (file batchedPolicyFile) discard() {
+	os.Remove(file.tempPolicyFile)
+	if file.backupFile != "" {
+		os.Remove(file.backupFile)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestPolicyUpdaterBatchFsync(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	domains := []string{"batch1", "batch2", "batch3", "batch4", "batch5"}
+	policies := map[string]*zts.DomainSignedPolicyData{}
+	for _, domain := range domains {
+		data, err := signPolicyData(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		policies[domain] = data
+	}
+	server := startPolicyServer(policies)
+	defer server.Close()
+	defer removePolicyFiles(domains...)
+
+	var syncs int32
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	syncFile = func(file *os.File) error {
+		atomic.AddInt32(&syncs, 1)
+		return file.Sync()
+	}
+
+	config := getServerConfiguration(server, strings.Join(domains, ","))
+	err := PolicyUpdater(config)
+	a.Nil(err)
+	a.Equal(int32(len(domains)), syncs, "Every policy file should be synced")
+	unbatched := readPolicyFiles(t, domains)
+	removePolicyFiles(domains...)
+
+	syncs = 0
+	config.BatchFsync = true
+	err = PolicyUpdater(config)
+	a.Nil(err)
+	a.Equal(int32(len(domains)+2), syncs, "Every staged file and the temporary and policy directories should be synced")
+	a.Equal(unbatched, readPolicyFiles(t, domains))
+	for _, domain := range domains {
+		a.Equal(util.Exists(fmt.Sprintf("%s/%s.tmp", TEMP_POLICIES_DIR, domain)), false)
+	}
+}
+
+func TestFsyncBatchCommitRenameFailure(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("batch1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+
+	batch := &fsyncBatch{}
+	a.Nil(batch.stage(config, data, "batch1", POLICIES_DIR, false, ""))
+	a.Nil(batch.stage(config, data, "batch2", "/tmp/zpu_missing_dir", false, ""))
+	errs := batch.commit(config, zmsClientForTest())
+	a.Equal(1, len(errs))
+	a.NotNil(errs["batch2"])
+	a.Equal(util.Exists(POLICIES_DIR+"/batch1.pol"), true)
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/batch2.tmp"), false, "The temporary file of a failed rename is removed")
+	removePolicyFiles("batch1")
+}
+
+func TestFsyncBatchCommitStrayDirectory(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("batchstray", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	policyFile := POLICIES_DIR + "/batchstray.pol"
+	require.Nil(t, os.MkdirAll(policyFile+"/stray", 0755))
+	defer removePolicyFiles("batchstray")
+	defer os.RemoveAll(policyFile)
+	config := getSigningConfiguration()
+
+	batch := &fsyncBatch{}
+	a.Nil(batch.stage(config, data, "batchstray", POLICIES_DIR, false, ""))
+	errs := batch.commit(config, zmsClientForTest())
+	var dirErr *PolicyPathIsDirectoryError
+	a.True(errors.As(errs["batchstray"], &dirErr), "The batch fails the domain like WritePolicies does")
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/batchstray.tmp"), false)
+
+	config.RemoveStrayPolicyDirs = true
+	batch = &fsyncBatch{}
+	a.Nil(batch.stage(config, data, "batchstray", POLICIES_DIR, false, ""))
+	errs = batch.commit(config, zmsClientForTest())
+	a.Empty(errs)
+	info, err := os.Stat(policyFile)
+	a.Nil(err)
+	a.False(info.IsDir(), "The policy file replaces the stray directory")
+}
+
+func readPolicyFiles(t *testing.T, domains []string) map[string]string {
+	files := map[string]string{}
+	for _, domain := range domains {
+		data, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.pol", POLICIES_DIR, domain))
+		require.Nil(t, err)
+		files[domain] = string(data)
+	}
+	return files
+}
@@ -0,0 +1,45 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"sync/atomic"
+)
+
+// CacheStats counts the lookups served by the caches of a configuration.
+// Public key lookups are counted across the ValidatePolicyDir runs sharing
+// fetched zms keys, revocation lookups across the CheckSigningCertRevocation
+// checks.
+type CacheStats struct {
+	PublicKeyHits    int64 `json:"publicKeyHits"`
+	PublicKeyMisses  int64 `json:"publicKeyMisses"`
+	RevocationHits   int64 `json:"revocationHits"`
+	RevocationMisses int64 `json:"revocationMisses"`
+}
+
+func (config *ZpuConfiguration) cacheCounters() *CacheStats {
+	config.initSharedState()
+	return config.cacheStats
+}
+
+// countLookup adds a lookup to the hits or misses counter
+func countLookup(hit bool, hits, misses *int64) {
+	if hit {
+		atomic.AddInt64(hits, 1)
+	} else {
+		atomic.AddInt64(misses, 1)
+	}
+}
+
+// CacheStats returns the cache lookups counted since the configuration was
+// first used
+func (config *ZpuConfiguration) CacheStats() CacheStats {
+	counters := config.cacheCounters()
+	return CacheStats{
+		PublicKeyHits:    atomic.LoadInt64(&counters.PublicKeyHits),
+		PublicKeyMisses:  atomic.LoadInt64(&counters.PublicKeyMisses),
+		RevocationHits:   atomic.LoadInt64(&counters.RevocationHits),
+		RevocationMisses: atomic.LoadInt64(&counters.RevocationMisses),
+	}
+}
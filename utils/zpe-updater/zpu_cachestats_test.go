@@ -0,0 +1,104 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/libs/go/zmssvctoken"
+)
+
+func TestCacheStats(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/cache_stats"
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{}
+	for i := 0; i < 3; i++ {
+		domain := fmt.Sprintf("stats%d", i)
+		data, err := testPolicySigner("0", "zms.stats").Sign(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(config, data, domain, dir))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: "zms.stats", Key: new(zmssvctoken.YBase64).EncodeToString([]byte(testPublicKey))})
+	}))
+	defer server.Close()
+
+	a.Equal(CacheStats{}, config.CacheStats())
+	config.PolicyFileDir = dir
+	config.ValidateConcurrency = 1
+	zmsClient := zms.NewClient(formatUrl(server.URL, "zms/v1"), nil)
+	_, err := ValidatePolicyDir(config, zmsClient)
+	a.Nil(err)
+	stats := config.CacheStats()
+	a.Equal(int64(1), stats.PublicKeyMisses)
+	a.Equal(int64(2), stats.PublicKeyHits, "The files sharing the key hit the cache")
+
+	_, err = ValidatePolicyDir(config, zmsClient)
+	a.Nil(err)
+	stats = config.CacheStats()
+	a.Equal(int64(2), stats.PublicKeyMisses, "Each run fetches the key once")
+	a.Equal(int64(4), stats.PublicKeyHits)
+
+	ca, caKey, caPEM := createTestCA(t, "Test CA")
+	responder := startCrlResponder(ca, caKey)
+	defer responder.Close()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config = getSigningConfiguration()
+	config.CheckSigningCertRevocation = true
+	config.SigningCertIssuer = caPEM
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 200, responder.URL)}
+	for i := 0; i < 3; i++ {
+		a.Nil(ValidateSignedPolicies(config, zmsClientForTest(), data))
+	}
+	stats = config.CacheStats()
+	a.Equal(int64(1), stats.RevocationMisses)
+	a.Equal(int64(2), stats.RevocationHits, "Repeated validations hit the revocation cache")
+}
+
+func TestCacheStatsConcurrentWorkers(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/cache_stats_workers"
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{}
+	for i := 0; i < 8; i++ {
+		domain := fmt.Sprintf("workers%d", i)
+		data, err := testPolicySigner("0", "zms.workers").Sign(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(config, data, domain, dir))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: "zms.workers", Key: new(zmssvctoken.YBase64).EncodeToString([]byte(testPublicKey))})
+	}))
+	defer server.Close()
+
+	//the workers are the first to use the counters of the configuration
+	config.PolicyFileDir = dir
+	config.ValidateConcurrency = 4
+	results, err := ValidatePolicyDir(config, zms.NewClient(formatUrl(server.URL, "zms/v1"), nil))
+	a.Nil(err)
+	a.Equal(8, len(results))
+	stats := config.CacheStats()
+	a.Equal(int64(8), stats.PublicKeyMisses+stats.PublicKeyHits)
+}
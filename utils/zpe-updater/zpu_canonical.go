@@ -0,0 +1,62 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// canonicalString is the default canonical form of the signed objects, tests
+// replace it to count the canonicalizations
+var canonicalString = util.ToCanonicalString
+
+// canonicalPolicyDataNull is the policy data member of the canonical form of
+// signed policy data without policy data
+const canonicalPolicyDataNull = `"policyData":null`
+
+// canonicalForms computes the canonical forms of the signed policy data and
+// of its policy data for a single validation. The policy data, the bulk of
+// both, is canonicalized once and embedded in the signed policy data form.
+// A CanonicalFunc is called on each object as is.
+type canonicalForms struct {
+	config           *ZpuConfiguration
+	signedPolicyData *zts.SignedPolicyData
+	policyData       *string
+}
+
+func (forms *canonicalForms) policyDataForm() (string, error) {
+	if forms.policyData != nil {
+		return *forms.policyData, nil
+	}
+	form, err := forms.config.ToCanonicalString(forms.signedPolicyData.PolicyData)
+	if err != nil {
+		return "", err
+	}
+	forms.policyData = &form
+	return form, nil
+}
+
+func (forms *canonicalForms) signedPolicyDataForm() (string, error) {
+	if forms.config.CanonicalFunc != nil {
+		return forms.config.CanonicalFunc(forms.signedPolicyData)
+	}
+	policyForm, err := forms.policyDataForm()
+	if err != nil {
+		return "", err
+	}
+	withoutPolicyData := *forms.signedPolicyData
+	withoutPolicyData.PolicyData = nil
+	form, err := canonicalString(&withoutPolicyData)
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(form, canonicalPolicyDataNull) {
+		return "", fmt.Errorf("Unable to embed the policy data in the canonical form of the signed policy data")
+	}
+	return strings.Replace(form, canonicalPolicyDataNull, `"policyData":`+policyForm, 1), nil
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestCanonicalFormsOncePerValidation(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+
+	calls := map[string]int{}
+	defer func(canonical func(interface{}) (string, error)) { canonicalString = canonical }(canonicalString)
+	canonicalString = func(obj interface{}) (string, error) {
+		name := fmt.Sprintf("%T", obj)
+		if signed, ok := obj.(*zts.SignedPolicyData); ok && signed.PolicyData == nil {
+			name += " without policy data"
+		}
+		calls[name]++
+		return util.ToCanonicalString(obj)
+	}
+	err = ValidateSignedPolicies(getSigningConfiguration(), zmsClientForTest(), data)
+	a.Nil(err)
+	a.Equal(map[string]int{"*zts.PolicyData": 1, "*zts.SignedPolicyData without policy data": 1}, calls, "The policy data is canonicalized once")
+
+	forms := &canonicalForms{config: &ZpuConfiguration{}, signedPolicyData: data.SignedPolicyData}
+	form, err := forms.signedPolicyDataForm()
+	a.Nil(err)
+	expected, err := util.ToCanonicalString(data.SignedPolicyData)
+	a.Nil(err)
+	a.Equal(expected, form, "The embedded policy data gives the canonical form of the whole object")
+}
+
+func BenchmarkValidateSignedPolicies(b *testing.B) {
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	if err != nil {
+		b.Fatal(err)
+	}
+	config := getSigningConfiguration()
+	zmsClient := zmsClientForTest()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := ValidateSignedPolicies(config, zmsClient, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
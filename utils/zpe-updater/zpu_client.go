@@ -6,12 +6,16 @@
 package zpu
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -25,28 +29,106 @@ import (
 )
 
 func PolicyUpdater(config *ZpuConfiguration) error {
+	_, err := UpdatePolicies(config)
+	return err
+}
+
+// UpdatePolicies fetches, validates and writes the policies of every domain
+// in the configuration, returning a summary of the run
+func UpdatePolicies(config *ZpuConfiguration) (*UpdateResult, error) {
 	if config == nil {
-		return errors.New("Nil configuration")
-	}
-	if config.DomainList == "" {
-		return errors.New("No domain list to process from configuration")
+		return nil, errors.New("Nil configuration")
 	}
+	config.initSharedState()
 	if config.Zms == "" {
-		return errors.New("Empty Zms url in configuration")
+		return nil, errors.New("Empty Zms url in configuration")
 	}
 	if config.Zts == "" {
-		return errors.New("Empty Zts url in configuration")
+		return nil, errors.New("Empty Zts url in configuration")
+	}
+	domains, err := ResolveDomainList(config)
+	if err != nil {
+		return nil, err
+	}
+	if len(domains) == 0 {
+		return nil, errors.New("No domain list to process from configuration")
+	}
+	if !validEnvironment(config.Environment) {
+		return nil, fmt.Errorf("Invalid environment: %v in configuration", config.Environment)
 	}
 	success := true
-	domains := strings.Split(config.DomainList, ",")
-	ztsUrl := formatUrl(config.Zts, "zts/v1")
-	ztsClient := zts.NewClient(ztsUrl, nil)
-	zmsUrl := formatUrl(config.Zms, "zms/v1")
-	zmsClient := zms.NewClient(zmsUrl, nil)
-	policyFileDir := config.PolicyFileDir
+	result := &UpdateResult{}
+	if config.DryRunPlan {
+		result.Plan = planPolicies(config, domains)
+		return result, nil
+	}
+	if len(config.PolicyFileDirs) > 0 && config.BatchFsync {
+		return nil, errors.New("PolicyFileDirs is not supported with BatchFsync")
+	}
+	if len(config.PolicyFileDirs) > 0 && config.VerifyAfterWrite {
+		return nil, errors.New("PolicyFileDirs is not supported with VerifyAfterWrite")
+	}
+	//nothing is created or written before every output directory is known to be writable
+	err = VerifyWritableDirs(config)
+	if err != nil {
+		return nil, err
+	}
+	clients := buildClients(config)
+	ztsClient := clients.zts
+	zmsClient := clients.zms
+	policyFileDir := config.policyDir()
+	if config.Environment != "" {
+		err = os.MkdirAll(policyFileDir, 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create policy directory: %v, Error:%v", policyFileDir, err)
+		}
+	}
+	for _, dir := range config.fanOutDirs() {
+		if config.Environment != "" {
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to create policy directory: %v, Error:%v", dir, err)
+			}
+		}
+		err = verifyWriteStrategy(config, dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = verifyWriteStrategy(config, policyFileDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.SweepTempFiles {
+		sweepTempFiles(config, policyFileDir)
+	}
 	failedDomains := ""
+	var resumedDomains map[string]bool
+	if config.ResumeLastRun {
+		resumedDomains = readJournal(config)
+	}
+	run := &runState{lastErrors: config.domainErrors()}
+	if config.LogSampleThreshold > 0 {
+		run.logs = newLogSampler(config.LogSampleThreshold)
+	}
+	if config.WriteDebounce > 0 {
+		run.debounce = config.debounceState()
+	}
+	if config.BatchFsync {
+		run.batch = &fsyncBatch{}
+	}
+	if config.GetClock().Now().Before(config.ReadOnlyUntil) {
+		log.Printf("Running in read-only mode until %v, policies will only be validated", config.ReadOnlyUntil)
+		run.readOnly = true
+		result.ReadOnly = true
+	}
+	run.emit(config, RunStarted, "", nil)
 	for _, domain := range domains {
-		err := GetPolicies(config, ztsClient, zmsClient, policyFileDir, domain)
+		if resumedDomains[domain] {
+			log.Printf("Skipping domain: %v, already updated by the interrupted run", domain)
+			continue
+		}
+		data, err := getPolicies(config, ztsClient, zmsClient, policyFileDir, domain, run)
 		if err != nil {
 			if success {
 				success = false
@@ -54,59 +136,255 @@ func PolicyUpdater(config *ZpuConfiguration) error {
 			failedDomains += `"`
 			failedDomains += domain
 			failedDomains += `" `
-			log.Printf("Failed to get policies for domain: %v, Error:%v", domain, err)
+			run.logs.logf(err, "Failed to get policies for domain: %v, Error:%v", domain, err)
+			result.FailedDomains = append(result.FailedDomains, domain)
+			run.lastErrors.set(domain, err)
+			run.emit(config, DomainFailed, domain, err)
+			continue
+		}
+		run.lastErrors.set(domain, nil)
+		if data != nil {
+			result.addUpdated(domain, data)
+			result.checkZmsSigner(config, domain, data)
+			if run.modified[domain] {
+				result.ModifiedDomains = append(result.ModifiedDomains, domain)
+			}
+			//a staged domain is fetched once the batch is committed
+			if !run.batch.staged(domain) {
+				run.emit(config, DomainFetched, domain, nil)
+			}
+		} else if run.debounced[domain] {
+			result.DebouncedDomains = append(result.DebouncedDomains, domain)
+		} else {
+			result.NotModifiedDomains = append(result.NotModifiedDomains, domain)
+			if len(config.AllowedZmsKeyIds) > 0 {
+				stored, err := readPolicyFile(config, config.policyFile(policyFileDir, domain))
+				if err == nil {
+					result.checkZmsSigner(config, domain, stored)
+				}
+			}
+			run.emit(config, DomainNotModified, domain, nil)
+		}
+		if config.ResumeLastRun && run.batch == nil && !run.readOnly {
+			appendJournal(config, domain)
 		}
 	}
+	if run.batch != nil {
+		errs := run.batch.commit(config, zmsClient)
+		for _, file := range run.batch.files {
+			err, failed := errs[file.domain]
+			if failed {
+				if success {
+					success = false
+				}
+				failedDomains += `"`
+				failedDomains += file.domain
+				failedDomains += `" `
+				run.logs.logf(err, "Failed to write policies for domain: %v, Error:%v", file.domain, err)
+				result.markFailed(file.domain)
+				run.lastErrors.set(file.domain, err)
+				run.emit(config, DomainFailed, file.domain, err)
+				continue
+			}
+			log.Printf("Policies for domain: %v successfully written", file.domain)
+			run.emit(config, DomainFetched, file.domain, nil)
+			if config.ResumeLastRun {
+				appendJournal(config, file.domain)
+			}
+		}
+	}
+	run.logs.summary()
+	if config.ResumeLastRun {
+		removeJournal(config)
+	}
+	alertExpiringPolicies(config, run, result.FailedDomains, policyFileDir)
 	metricFilesPath := config.MetricsDir
-	if metricFilesPath != "" {
-		err := PostAllDomainMetric(ztsClient, metricFilesPath)
+	if metricFilesPath != "" && emptyMetricsDir(metricFilesPath) {
+		if !config.QuietEmptyMetrics {
+			log.Printf("No metrics to post, metrics directory: %v is empty", metricFilesPath)
+		}
+	} else if metricFilesPath != "" {
+		metricsPoster := clients.metricsPoster(config)
+		var err error
+		if config.MetricsQueueDepth > 0 {
+			err = postDomainMetricPipeline(metricsPoster, metricFilesPath, config.MetricsQueueDepth, config.MetricsConcurrency, config.MaxMetricFilesPerRun, config.metricFileKey())
+		} else {
+			err = postDomainMetricBatches(metricsPoster, metricFilesPath, config.MetricsBatchSize, config.MetricsConcurrency, config.MaxMetricFilesPerRun, config.metricFileKey())
+		}
 		if err != nil {
 			log.Printf("Posting of metrics to Zts failed, Error:%v", err)
 		}
 	}
+	if config.PrometheusTextfile != "" {
+		err := writePrometheusTextfile(config, result, domains, policyFileDir, success)
+		if err != nil {
+			log.Printf("Unable to write the prometheus textfile: %v, Error:%v", config.PrometheusTextfile, err)
+		}
+	}
+	run.emit(config, RunFinished, "", nil)
+	result.DroppedEvents = run.droppedEvents
+	if config.RunResultWebhook != "" {
+		postRunResult(config, result)
+	}
 	if !success {
-		return fmt.Errorf("Failed to get policies for domains: %v", failedDomains)
+		if !config.returnErrorOnPartialFailure() {
+			log.Printf("Failed to get policies for domains: %v", failedDomains)
+			return result, nil
+		}
+		return result, fmt.Errorf("Failed to get policies for domains: %v", failedDomains)
 	}
-	return nil
+	return result, nil
 }
 
 func GetPolicies(config *ZpuConfiguration, ztsClient zts.ZTSClient, zmsClient zms.ZMSClient, policyFileDir, domain string) error {
+	_, err := getPolicies(config, ztsClient, zmsClient, policyFileDir, domain, &runState{})
+	return err
+}
+
+// runState holds the settings and state shared by all domains of a run
+type runState struct {
+	// batch stages the policy files until the end of the run when set
+	batch *fsyncBatch
+	// readOnly validates the fetched policies without writing them
+	readOnly bool
+	// droppedEvents counts the events not sent on a full EventChannel
+	droppedEvents int
+	// logs samples the domain error logs when set
+	logs *logSampler
+	// modified holds the domains changed by the PostValidateTransform
+	modified map[string]bool
+	// debounce delays the writes of changed policies when set, debounced
+	// holds the domains whose change is not written yet
+	debounce  *debounceState
+	debounced map[string]bool
+	// lastErrors records the outcome of every domain for LastError
+	lastErrors *domainErrors
+}
+
+// getPolicies returns the policy data fetched for the domain, or nil if the
+// policies were not modified since the last fetch or their write is
+// debounced. With a batch the policy file is only staged and written when
+// the batch is committed.
+func getPolicies(config *ZpuConfiguration, ztsClient zts.ZTSClient, zmsClient zms.ZMSClient, policyFileDir, domain string, run *runState) (*zts.DomainSignedPolicyData, error) {
 	log.Printf("Getting policies for domain: %v", domain)
-	etag, err := GetEtagForExistingPolicy(config, zmsClient, domain, policyFileDir)
-	if err != nil {
-		return fmt.Errorf("Failed to get Etag for domain: %v, Error: %v", domain, err)
+	plan := planDomain(config, domain, policyFileDir)
+	if plan.Action == PLAN_FAIL {
+		return nil, fmt.Errorf("Failed to get Etag for domain: %v, Error: %v", domain, plan.err)
 	}
-	data, _, err := ztsClient.GetDomainSignedPolicyData(zts.DomainName(domain), etag)
+	var etag string
+	if plan.Action == PLAN_FULL_FETCH {
+		log.Printf("Fetching all policies for domain: %v, %v", domain, plan.Reason)
+	} else {
+		//the stored policies are validated before they are kept or their etag is used
+		var err error
+		etag, err = GetEtagForExistingPolicy(config, zmsClient, domain, policyFileDir)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get Etag for domain: %v, Error: %v", domain, err)
+		}
+		if plan.Action == PLAN_SKIP {
+			log.Printf("Skipping fetch of policies for domain: %v, %v", domain, plan.Reason)
+			return nil, keepStoredPolicies(config, domain, policyFileDir, etag, run)
+		}
+	}
+	data, serverEtag, err := fetchSignedPolicyData(config, ztsClient, domain, etag)
 	if err != nil {
-		return fmt.Errorf("Failed to get domain signed policy data for domain: %v, Error:%v", domain, err)
+		return nil, err
 	}
+	trackIneffectiveEtag(config, domain, etag, data)
 
 	if data == nil {
 		if etag != "" {
 			log.Printf("Policies not updated since last fetch for domain: %v", domain)
-			return nil
+			return nil, keepStoredPolicies(config, domain, policyFileDir, etag, run)
 		} else {
-			return fmt.Errorf("Empty policies data returned for domain: %v", domain)
+			return nil, fmt.Errorf("Empty policies data returned for domain: %v", domain)
 		}
 	}
 	//validate data using zts public key and signature
-	err = ValidateSignedPolicies(config, zmsClient, data)
+	keys, err := verifySignedPolicies(config, zmsPublicKeyGetter(config, zmsClient), data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to validate policy data for domain: %v, Error: %v", domain, err)
+	}
+	err = checkRollback(config, data, domain, policyFileDir)
+	if err != nil {
+		return nil, err
+	}
+	if config.DetectAlgorithmDowngrade {
+		checkAlgorithmDowngrade(config, keys, domain, policyFileDir, !run.readOnly)
+	}
+	modified, err := applyPostValidateTransform(config, data, domain)
 	if err != nil {
-		return fmt.Errorf("Failed to validate policy data for domain: %v, Error: %v", domain, err)
+		return nil, err
+	}
+	if modified {
+		log.Printf("Policies for domain: %v modified by the post validation transform, signatures no longer verify", domain)
+		if run.modified == nil {
+			run.modified = make(map[string]bool)
+		}
+		run.modified[domain] = true
+	}
+	if run.readOnly {
+		log.Printf("Policies for domain: %v validated, not written in read-only mode", domain)
+		return data, nil
+	}
+	if run.debounce != nil {
+		write, reason := run.debounce.shouldWrite(config, data, domain, policyFileDir)
+		if !write {
+			log.Printf("Delaying write of policies for domain: %v, %v", domain, reason)
+			if run.debounced == nil {
+				run.debounced = make(map[string]bool)
+			}
+			run.debounced[domain] = true
+			return nil, nil
+		}
+	}
+	if run.batch != nil {
+		err = run.batch.stage(config, data, domain, policyFileDir, modified, serverEtag)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to stage Policies for domain:\"%v\" to file, Error:%v", domain, err)
+		}
+		return data, nil
+	}
+	if config.VerifyAfterWrite {
+		err = writeVerifiedPolicies(config, zmsClient, data, domain, policyFileDir, modified)
+	} else {
+		err = WritePolicies(config, data, domain, policyFileDir)
+	}
+	for _, dir := range append([]string{policyFileDir}, config.fanOutDirs()...) {
+		if err == nil {
+			err = updateModifiedMarker(config.policyFile(dir, domain), modified)
+		}
+	}
+	if err == nil && config.StoreServerEtag {
+		err = updateServerEtag(config, data, domain, config.policyFile(policyFileDir, domain), serverEtag)
+	}
+	if err == nil && config.OpaDataDir != "" {
+		err = writeOpaData(config, data, domain)
 	}
-	err = WritePolicies(config, data, domain, policyFileDir)
 	if err != nil {
-		return fmt.Errorf("Unable to write Policies for domain:\"%v\" to file, Error:%v", domain, err)
+		return nil, fmt.Errorf("Unable to write Policies for domain:\"%v\" to file, Error:%v", domain, err)
 	}
 	log.Printf("Policies for domain: %v successfully written", domain)
-	return nil
+	return data, nil
+}
+
+// keepStoredPolicies completes the outputs of the stored policies that are
+// kept for the domain. Only policies validated for their etag are used.
+func keepStoredPolicies(config *ZpuConfiguration, domain, policyFileDir, etag string, run *runState) error {
+	if etag == "" || run.readOnly {
+		return nil
+	}
+	return ensureOpaData(config, domain, policyFileDir)
 }
 
 func GetEtagForExistingPolicy(config *ZpuConfiguration, zmsClient zms.ZMSClient, domain, policyFileDir string) (string, error) {
 	var etag string
-	var domainSignedPolicyData *zts.DomainSignedPolicyData
 
-	policyFile := fmt.Sprintf("%s/%s.pol", policyFileDir, domain)
+	policyFile := config.policyFile(policyFileDir, domain)
+	err := policyPathIsDirectory(policyFile)
+	if err != nil {
+		return "", err
+	}
 
 	// If Policies file is not found, return empty etag the first time
 	// else load the file contents, if data has expired return empty etag, else construct etag from modified field in Json
@@ -114,24 +392,34 @@ func GetEtagForExistingPolicy(config *ZpuConfiguration, zmsClient zms.ZMSClient,
 	if !exists {
 		return "", nil
 	}
+	if config.RefuseWorldWritablePolicies {
+		if reason := worldWritablePolicy(policyFile); reason != "" {
+			log.Printf("Refusing stored policies for domain: %v, %v", domain, reason)
+			return "", nil
+		}
+	}
 
-	readFile, err := os.OpenFile(policyFile, os.O_RDONLY, 0444)
-	defer readFile.Close()
+	domainSignedPolicyData, err := readPolicyFile(config, policyFile)
 	if err != nil {
 		return "", err
 	}
-	err = json.NewDecoder(readFile).Decode(&domainSignedPolicyData)
+	err = ValidateSignedPolicies(config, zmsClient, domainSignedPolicyData)
 	if err != nil {
 		return "", err
 	}
-	err = ValidateSignedPolicies(config, zmsClient, domainSignedPolicyData)
+	err = checkStartUpDelay(config, domainSignedPolicyData, domain)
 	if err != nil {
 		return "", err
 	}
 	expires := domainSignedPolicyData.SignedPolicyData.Expires
-	if expired(rdl.NewTimestamp(expires.Time.Add(time.Duration(int64(config.StartUpDelay)) * time.Second))) {
+	if expiredAt(config.GetClock().Now(), rdl.NewTimestamp(expires.Time.Add(time.Duration(int64(config.StartUpDelay))*time.Second))) {
 		return "", nil
 	}
+	if config.StoreServerEtag {
+		if etag = storedServerEtag(policyFile, domainSignedPolicyData); etag != "" {
+			return etag, nil
+		}
+	}
 	modified := domainSignedPolicyData.SignedPolicyData.Modified
 	if !modified.IsZero() {
 
@@ -140,59 +428,287 @@ func GetEtagForExistingPolicy(config *ZpuConfiguration, zmsClient zms.ZMSClient,
 	return etag, nil
 }
 
+// StartUpDelayError is reported when the StartUpDelay, which extends the
+// usable life of stored policies, is large compared to their validity.
+type StartUpDelayError struct {
+	Domain       string
+	StartUpDelay time.Duration
+	Validity     time.Duration
+}
+
+func (e *StartUpDelayError) Error() string {
+	return fmt.Sprintf("StartUpDelay of %v exceeds %v of the %v validity of the policies of domain: %v, expired policies may be used", e.StartUpDelay, STARTUP_DELAY_VALIDITY_FRACTION, e.Validity, e.Domain)
+}
+
+// checkStartUpDelay warns, or fails with StrictStartUpDelay, when the
+// StartUpDelay exceeds STARTUP_DELAY_VALIDITY_FRACTION of the validity of
+// the policy data
+func checkStartUpDelay(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain string) error {
+	if config.StartUpDelay <= 0 {
+		return nil
+	}
+	delay := time.Duration(config.StartUpDelay) * time.Second
+	validity := data.SignedPolicyData.Expires.Time.Sub(data.SignedPolicyData.Modified.Time)
+	if float64(delay) <= float64(validity)*STARTUP_DELAY_VALIDITY_FRACTION {
+		return nil
+	}
+	err := &StartUpDelayError{Domain: domain, StartUpDelay: delay, Validity: validity}
+	if config.StrictStartUpDelay {
+		return err
+	}
+	log.Printf("Warning: %v", err)
+	return nil
+}
+
+// worldWritablePolicy returns why the policy file could have been tampered
+// with when the file or its directory is world-writable, "" otherwise
+func worldWritablePolicy(policyFile string) string {
+	for _, path := range []string{policyFile, filepath.Dir(policyFile)} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Sprintf("unable to stat %v: %v", path, err)
+		}
+		if info.Mode().Perm()&0002 != 0 {
+			return fmt.Sprintf("%v is world-writable with mode %v", path, info.Mode().Perm())
+		}
+	}
+	return ""
+}
+
+// openPolicyFile opens a policy file for reading, tests replace it to
+// observe the open files
+var openPolicyFile = func(policyFile string) (io.ReadCloser, error) {
+	return os.OpenFile(policyFile, os.O_RDONLY, 0444)
+}
+
+// readPolicyFile decodes the policy file while holding one of the
+// configured MaxOpenFiles slots
+func readPolicyFile(config *ZpuConfiguration, policyFile string) (*zts.DomainSignedPolicyData, error) {
+	openFiles := config.openFileSemaphore()
+	openFiles.acquire()
+	defer openFiles.release()
+	readFile, err := openPolicyFile(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer readFile.Close()
+	domainSignedPolicyData, err := decodePolicyData(readFile, config.StrictJSONDecode, config.MaxJSONDepth, policyFile)
+	if err != nil {
+		return nil, err
+	}
+	if domainSignedPolicyData == nil || domainSignedPolicyData.SignedPolicyData == nil {
+		return nil, fmt.Errorf("No signed policy data found in policy file: %v", policyFile)
+	}
+	return domainSignedPolicyData, nil
+}
+
+// PolicyRollbackError is returned when zts returns policy data that was
+// modified before the policy data already stored for the domain.
+type PolicyRollbackError struct {
+	Domain   string
+	Stored   rdl.Timestamp
+	Returned rdl.Timestamp
+}
+
+func (e *PolicyRollbackError) Error() string {
+	return fmt.Sprintf("Zts returned policies for domain: %v modified on %v which is older than the stored policies modified on %v", e.Domain, e.Returned, e.Stored)
+}
+
+// checkRollback compares the fetched policy data against the stored policy
+// file, whether the data was fetched conditionally or in full
+func checkRollback(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain, policyFileDir string) error {
+	policyFile := config.policyFile(policyFileDir, domain)
+	if !util.Exists(policyFile) {
+		return nil
+	}
+	stored, err := readPolicyFile(config, policyFile)
+	if err != nil {
+		log.Printf("Unable to read stored policies for domain: %v to check for rollback, Error:%v", domain, err)
+		return nil
+	}
+	storedModified := stored.SignedPolicyData.Modified
+	returnedModified := data.SignedPolicyData.Modified
+	if returnedModified.Time.Before(storedModified.Time) {
+		return &PolicyRollbackError{Domain: domain, Stored: storedModified, Returned: returnedModified}
+	}
+	return nil
+}
+
+// InvalidExpiryError is returned when the signed policy data expires at or
+// before the time it was last modified.
+type InvalidExpiryError struct {
+	Modified rdl.Timestamp
+	Expires  rdl.Timestamp
+}
+
+func (e *InvalidExpiryError) Error() string {
+	return fmt.Sprintf("The policy data expires on %v which is not after its modified time %v", e.Expires, e.Modified)
+}
+
+// FutureModifiedError is returned when the signed policy data was modified
+// further in the future than the MaxFutureModifiedSkew, a sign of a clock
+// issue or of tampering.
+type FutureModifiedError struct {
+	Modified rdl.Timestamp
+	Skew     time.Duration
+}
+
+func (e *FutureModifiedError) Error() string {
+	return fmt.Sprintf("The policy data modified time %v is more than %v in the future", e.Modified, e.Skew)
+}
+
+// UntrustedZtsIdentityError is returned when the policy data was signed by a
+// zts key id missing from the configured AllowedZtsIdentities.
+type UntrustedZtsIdentityError struct {
+	KeyId string
+}
+
+func (e *UntrustedZtsIdentityError) Error() string {
+	return fmt.Sprintf("The policy data is signed by zts key id:\"%v\" which is not an allowed zts identity", e.KeyId)
+}
+
+// UnexpectedZmsKeyIdError is returned when the policy data of a domain is
+// signed by a zms key id other than the one configured in DomainKeyIds.
+type UnexpectedZmsKeyIdError struct {
+	Domain   string
+	KeyId    string
+	Expected string
+}
+
+func (e *UnexpectedZmsKeyIdError) Error() string {
+	return fmt.Sprintf("The policy data of domain: %v is signed by zms key id:\"%v\", expected zms key id:\"%v\"", e.Domain, e.KeyId, e.Expected)
+}
+
 func ValidateSignedPolicies(config *ZpuConfiguration, zmsClient zms.ZMSClient, data *zts.DomainSignedPolicyData) error {
+	_, err := verifySignedPolicies(config, zmsPublicKeyGetter(config, zmsClient), data)
+	return err
+}
+
+// zmsPublicKeyGetter looks up the public keys missing from the configuration
+// in zms
+func zmsPublicKeyGetter(config *ZpuConfiguration, zmsClient zms.ZMSClient) publicKeyGetter {
+	return func(service, keyId string) (string, error) {
+		return fetchPublicKey(config, zmsClient, service, keyId)
+	}
+}
+
+// validateSignedPolicies validates the policy data, public keys missing from
+// the configuration are looked up with getPublicKey. With TrustedRootKeys
+// the signatures are verified with the trusted roots instead, whatever the
+// key ids.
+func validateSignedPolicies(config *ZpuConfiguration, getPublicKey publicKeyGetter, data *zts.DomainSignedPolicyData) error {
+	_, err := verifySignedPolicies(config, getPublicKey, data)
+	return err
+}
+
+// signerKeys are the public keys the zts and zms signatures verified with
+type signerKeys struct {
+	zts string
+	zms string
+}
+
+// verifySignedPolicies validates the policy data like validateSignedPolicies
+// and returns the public keys its signatures verified with
+func verifySignedPolicies(config *ZpuConfiguration, getPublicKey publicKeyGetter, data *zts.DomainSignedPolicyData) (*signerKeys, error) {
 	expires := data.SignedPolicyData.Expires
-	if expired(expires) {
-		return fmt.Errorf("The policy data is expired on %v", expires)
+	if expiredAt(config.GetClock().Now(), expires) {
+		return nil, fmt.Errorf("The policy data is expired on %v", expires)
+	}
+	modified := data.SignedPolicyData.Modified
+	if !expires.Time.After(modified.Time) {
+		return nil, &InvalidExpiryError{Modified: modified, Expires: expires}
+	}
+	skew := config.MaxFutureModifiedSkew
+	if skew > 0 && modified.Time.After(config.GetClock().Now().Add(skew)) {
+		return nil, &FutureModifiedError{Modified: modified, Skew: skew}
 	}
 	signedPolicyData := data.SignedPolicyData
 	ztsSignature := data.Signature
 	ztsKeyId := data.KeyId
-
-	ztsPublicKey := config.GetZtsPublicKey(ztsKeyId)
-	if ztsPublicKey == "" {
-		key, err := zmsClient.GetPublicKeyEntry("sys.auth", "zts", ztsKeyId)
-		if err != nil {
-			return fmt.Errorf("Unable to get the Zts public key with id:\"%v\" to verify data", ztsKeyId)
-		}
-		decodedKey, err := new(zmssvctoken.YBase64).DecodeString(key.Key)
+	if !config.isAllowedZtsIdentity(ztsKeyId) {
+		return nil, &UntrustedZtsIdentityError{KeyId: ztsKeyId}
+	}
+	if config.CheckSigningCertRevocation {
+		err := checkSigningCertRevocation(config, ztsKeyId)
 		if err != nil {
-			return fmt.Errorf("Unable to decode the Zts public key with id:\"%v\" to verify data", ztsKeyId)
+			return nil, err
 		}
-		ztsPublicKey = string(decodedKey)
 	}
-	input, err := util.ToCanonicalString(signedPolicyData)
+
+	ztsPublicKeys, err := signerPublicKeys(config, getPublicKey, "zts", ztsKeyId)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	forms := &canonicalForms{config: config, signedPolicyData: signedPolicyData}
+	input, err := forms.signedPolicyDataForm()
+	if err != nil {
+		return nil, err
 	}
-	err = verify(input, ztsSignature, ztsPublicKey)
+	keys := &signerKeys{}
+	keys.zts, err = verifyWithAnyKey(config, "zts", input, ztsSignature, ztsPublicKeys)
 	if err != nil {
-		return fmt.Errorf("Verification of data with zts key having id:\"%v\" failed, Error :%v", ztsKeyId, err)
+		return nil, fmt.Errorf("Verification of data with zts key having id:\"%v\" failed, Error :%w", ztsKeyId, err)
 	}
 	zmsSignature := data.SignedPolicyData.ZmsSignature
 	zmsKeyId := data.SignedPolicyData.ZmsKeyId
-	zmsPublicKey := config.GetZmsPublicKey(zmsKeyId)
-	if zmsPublicKey == "" {
-		key, err := zmsClient.GetPublicKeyEntry("sys.auth", "zms", zmsKeyId)
-		if err != nil {
-			return fmt.Errorf("Unable to get the Zms public key with id:\"%v\" to verify data", zmsKeyId)
-		}
-		decodedKey, err := new(zmssvctoken.YBase64).DecodeString(key.Key)
-		if err != nil {
-			return fmt.Errorf("Unable to decode the Zms public key with id:\"%v\" to verify data", zmsKeyId)
+	if config.WarnIdenticalSignerKeys && zmsKeyId == ztsKeyId {
+		log.Printf("Warning: the zts and zms signatures both use the key id:\"%v\", the signers may be misconfigured", ztsKeyId)
+	}
+	if data.SignedPolicyData.PolicyData != nil {
+		domain := string(data.SignedPolicyData.PolicyData.Domain)
+		if expected, ok := config.DomainKeyIds[domain]; ok && expected != zmsKeyId {
+			return nil, &UnexpectedZmsKeyIdError{Domain: domain, KeyId: zmsKeyId, Expected: expected}
 		}
-		zmsPublicKey = string(decodedKey)
 	}
-	policyData := data.SignedPolicyData.PolicyData
-	input, err = util.ToCanonicalString(policyData)
+	zmsPublicKeys, err := signerPublicKeys(config, getPublicKey, "zms", zmsKeyId)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	err = verify(input, zmsSignature, zmsPublicKey)
+	input, err = forms.policyDataForm()
 	if err != nil {
-		return fmt.Errorf("Verification of data with zms key with id:\"%v\" failed, Error :%v", zmsKeyId, err)
+		return nil, err
+	}
+	keys.zms, err = verifyWithAnyKey(config, "zms", input, zmsSignature, zmsPublicKeys)
+	if err != nil {
+		return nil, fmt.Errorf("Verification of data with zms key with id:\"%v\" failed, Error :%w", zmsKeyId, err)
+	}
+	return keys, nil
+}
+
+// VerifyTimeoutError is returned when a signature is not verified within
+// the VerifyTimeout
+type VerifyTimeoutError struct {
+	Timeout time.Duration
+}
+
+func (e *VerifyTimeoutError) Error() string {
+	return fmt.Sprintf("Signature verification did not complete within %v", e.Timeout)
+}
+
+// verifySignature verifies the signatures of the policy data, tests replace
+// it to slow down the verification
+var verifySignature = verify
+
+// verifyWithTimeout verifies the signature, giving up with a
+// VerifyTimeoutError after the VerifyTimeout when one is configured. The
+// abandoned verification completes in the background.
+func verifyWithTimeout(config *ZpuConfiguration, input, signature, publicKey string) error {
+	if config.VerifyTimeout <= 0 {
+		return verifySignature(input, signature, publicKey)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), config.VerifyTimeout)
+	defer cancel()
+	verifyFunc := verifySignature
+	done := make(chan error, 1)
+	go func() {
+		done <- verifyFunc(input, signature, publicKey)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return &VerifyTimeoutError{Timeout: config.VerifyTimeout}
 	}
-	return nil
 }
 
 func verify(input, signature, publicKey string) error {
@@ -205,7 +721,12 @@ func verify(input, signature, publicKey string) error {
 }
 
 func expired(expires rdl.Timestamp) bool {
-	if rdl.TimestampNow().Millis() > expires.Millis() {
+	return expiredAt(SystemClock{}.Now(), expires)
+}
+
+// expiredAt reports whether the expiry is before the given time
+func expiredAt(now time.Time, expires rdl.Timestamp) bool {
+	if rdl.NewTimestamp(now).Millis() > expires.Millis() {
 		return true
 	} else {
 		return false
@@ -213,38 +734,246 @@ func expired(expires rdl.Timestamp) bool {
 }
 
 // If domain policy file is not found, create the policy file and write policies in it
-// else delete the existing file and write the modified policies to new file
+// else delete the existing file and write the modified policies to new file.
+// The policy file is written to every PolicyFileDirs directory as well, the
+// temporary files of all the directories are written and the directories
+// checked before any file is moved into place, so a failed write leaves
+// every directory with its previous policy file.
 func WritePolicies(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain, policyFileDir string) error {
-	tempPolicyFileDir := config.TmpPolicyFileDir
+	tempPolicyFileDir := config.tmpPolicyDir()
 	if tempPolicyFileDir == "" || data == nil {
 		return errors.New("Empty parameters are not valid arguments")
 	}
-	policyFile := fmt.Sprintf("%s/%s.pol", policyFileDir, domain)
+	policyFileDirs := append([]string{policyFileDir}, config.fanOutDirs()...)
+	tempPolicyFiles := make([]string, 0, len(policyFileDirs))
+	for i := range policyFileDirs {
+		name := domain
+		if i > 0 {
+			name = fmt.Sprintf("%s.%d", domain, i)
+		}
+		var tempPolicyFile string
+		err := retryWrite(config, "write temporary policy file of domain: "+domain, func() error {
+			var err error
+			tempPolicyFile, err = writeTempPolicyFile(config, data, name, true)
+			return err
+		})
+		if err != nil {
+			for _, written := range tempPolicyFiles {
+				os.Remove(written)
+			}
+			return err
+		}
+		tempPolicyFiles = append(tempPolicyFiles, tempPolicyFile)
+	}
+	for _, dir := range policyFileDirs {
+		info, err := os.Stat(dir)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%v is not a directory", dir)
+		}
+		if err == nil {
+			err = checkPolicyFilePath(config, config.policyFile(dir, domain))
+		}
+		if err != nil {
+			for _, written := range tempPolicyFiles {
+				os.Remove(written)
+			}
+			return fmt.Errorf("Unable to write policy files of domain: %v, Error:%w", domain, err)
+		}
+	}
+	for i, dir := range policyFileDirs {
+		policyFile := config.policyFile(dir, domain)
+		err := movePolicyFile(config, tempPolicyFiles[i], policyFile)
+		if err != nil {
+			for _, remaining := range tempPolicyFiles[i:] {
+				os.Remove(remaining)
+			}
+			return fmt.Errorf("Unable to write policy file: %v, Error:%v", policyFile, err)
+		}
+	}
+	return nil
+}
+
+// PolicyPathIsDirectoryError is returned when a directory is found where
+// the policy file of a domain is expected.
+type PolicyPathIsDirectoryError struct {
+	Path string
+}
+
+func (e *PolicyPathIsDirectoryError) Error() string {
+	return fmt.Sprintf("The policy file path: %v is a directory, remove it or set RemoveStrayPolicyDirs", e.Path)
+}
+
+// policyPathIsDirectory returns a PolicyPathIsDirectoryError when the policy
+// file path is a directory, the paths that only read the policy file report
+// it whatever the RemoveStrayPolicyDirs
+func policyPathIsDirectory(policyFile string) error {
+	info, err := os.Lstat(policyFile)
+	if err != nil || !info.IsDir() {
+		return nil
+	}
+	return &PolicyPathIsDirectoryError{Path: policyFile}
+}
+
+// checkPolicyFilePath fails with a PolicyPathIsDirectoryError when the policy
+// file path is a directory, which is removed instead with
+// RemoveStrayPolicyDirs. Only the writes of the policy file check it.
+func checkPolicyFilePath(config *ZpuConfiguration, policyFile string) error {
+	err := policyPathIsDirectory(policyFile)
+	if err == nil || !config.RemoveStrayPolicyDirs {
+		return err
+	}
+	log.Printf("Removing stray directory at policy file path: %v", policyFile)
+	err = os.RemoveAll(policyFile)
+	if err != nil {
+		return fmt.Errorf("Unable to remove stray directory: %v, Error:%v", policyFile, err)
+	}
+	return nil
+}
+
+// movePolicyFile moves the temporary policy file into place like every write
+// of a policy file does: a stray directory at the policy file path fails the
+// move or is removed with RemoveStrayPolicyDirs, and the move is retried up
+// to WriteRetries times
+func movePolicyFile(config *ZpuConfiguration, tempPolicyFile, policyFile string) error {
+	err := checkPolicyFilePath(config, policyFile)
+	if err != nil {
+		return err
+	}
+	return retryWrite(config, "move policy file: "+policyFile+" into place", func() error {
+		return commitPolicyFile(config, tempPolicyFile, policyFile)
+	})
+}
+
+// linkFile creates a hard link to the file, tests replace it to simulate a
+// filesystem refusing links
+var linkFile = os.Link
+
+// commitPolicyFile moves the temporary policy file into place using the
+// configured write strategy. With the hardlink strategy the temporary file
+// is linked to an intermediate name in the policy directory, which is then
+// renamed over the policy file, so the previous policy file stays in place
+// until it is replaced.
+func commitPolicyFile(config *ZpuConfiguration, tempPolicyFile, policyFile string) error {
+	switch config.WriteStrategy {
+	case "", WRITE_STRATEGY_RENAME:
+		return os.Rename(tempPolicyFile, policyFile)
+	case WRITE_STRATEGY_HARDLINK:
+		linkedFile := policyFile + ".link"
+		os.Remove(linkedFile)
+		err := linkFile(tempPolicyFile, linkedFile)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(linkedFile, policyFile)
+		if err != nil {
+			os.Remove(linkedFile)
+			return err
+		}
+		return os.Remove(tempPolicyFile)
+	default:
+		return fmt.Errorf("Unknown write strategy: %v", config.WriteStrategy)
+	}
+}
+
+// retryWrite runs the write step, retrying it up to WriteRetries times after
+// WriteRetryBackoff. Permission errors and missing files are not retried,
+// they do not go away by themselves like a network filesystem hiccup does.
+func retryWrite(config *ZpuConfiguration, description string, write func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if err == nil || attempt >= config.WriteRetries || os.IsPermission(err) || os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("Attempt %v to %v failed, Error:%v", attempt+1, description, err)
+		config.GetClock().Sleep(config.WriteRetryBackoff)
+	}
+}
+
+// verifyWriteStrategy checks that the configured write strategy can move a
+// file from the temporary policy directory to the policy directory
+func verifyWriteStrategy(config *ZpuConfiguration, policyFileDir string) error {
+	switch config.WriteStrategy {
+	case "", WRITE_STRATEGY_RENAME:
+		return nil
+	case WRITE_STRATEGY_HARDLINK:
+	default:
+		return fmt.Errorf("Unknown write strategy: %v", config.WriteStrategy)
+	}
+	err := verifyTmpDirSetup(config.tmpPolicyDir())
+	if err != nil {
+		return err
+	}
+	probeFile := fmt.Sprintf("%s/.zpu_write_probe.tmp", config.tmpPolicyDir())
+	targetFile := fmt.Sprintf("%s/.zpu_write_probe", policyFileDir)
+	err = ioutil.WriteFile(probeFile, []byte{}, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to create write strategy probe file, Error:%v", err)
+	}
+	os.Remove(targetFile)
+	err = commitPolicyFile(config, probeFile, targetFile)
+	os.Remove(probeFile)
+	os.Remove(targetFile)
+	if err != nil {
+		return fmt.Errorf("Write strategy: %v is not supported for policy directory: %v, Error:%v", config.WriteStrategy, policyFileDir, err)
+	}
+	return nil
+}
+
+// syncFile flushes the file to stable storage, tests replace it to count syncs
+var syncFile = func(file *os.File) error {
+	return file.Sync()
+}
+
+// writeTempPolicyFile writes the policy data to the temporary policy file of
+// the domain and returns its path, optionally syncing the file contents
+func writeTempPolicyFile(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain string, sync bool) (string, error) {
+	tempPolicyFileDir := config.tmpPolicyDir()
 	tempPolicyFile := fmt.Sprintf("%s/%s.tmp", tempPolicyFileDir, domain)
 	if util.Exists(tempPolicyFile) {
 		err := os.Remove(tempPolicyFile)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
 	bytes, err := json.Marshal(&data)
 	if err != nil {
-		return err
+		return "", err
 	}
 	err = verifyTmpDirSetup(tempPolicyFileDir)
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = ioutil.WriteFile(tempPolicyFile, bytes, 0755)
+	file, err := os.OpenFile(tempPolicyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
 	if err != nil {
-		return err
+		return "", err
+	}
+	_, err = file.Write(bytes)
+	if err == nil && sync {
+		err = syncFile(file)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
 	}
-	os.Rename(tempPolicyFile, policyFile)
+	if err != nil {
+		return "", err
+	}
+	return tempPolicyFile, nil
+}
+
+func syncDir(dir string) error {
+	return syncPath(dir)
+}
+
+// syncPath flushes the file or directory at the path to stable storage
+func syncPath(path string) error {
+	file, err := os.Open(path)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer file.Close()
+	return syncFile(file)
 }
 
 func verifyTmpDirSetup(TempPolicyFileDir string) error {
@@ -259,41 +988,31 @@ func verifyTmpDirSetup(TempPolicyFileDir string) error {
 }
 
 func PostAllDomainMetric(ztsClient zts.ZTSClient, metricFilePath string) error {
-	m, err := aggregateAllDomainMetrics(metricFilePath)
-	if err != nil {
-		return err
-	}
-	if m != nil {
-		for key, value := range m {
-
-			data, err := buildDomainMetrics(key, value)
-			if err != nil {
-				return err
-			}
-			log.Printf("Posting Domain metric for domain %v to Zts", key)
-			data, err = ztsClient.PostDomainMetrics(zts.DomainName(key), data)
-			if err != nil {
-				log.Printf("Failed to post metrics for domain %v to Zts", key)
-				return err
-			}
-			deleteDomainMetricFiles(metricFilePath, key)
-		}
-	}
-	return nil
+	return postDomainMetricBatches(ztsClient, metricFilePath, 0, 1, 0, defaultMetricFileKey)
 }
 
 func aggregateAllDomainMetrics(metricFilePath string) (map[string]map[string]int, error) {
-	var m = make(map[string]map[string]int)
-	var fileMap = make(map[string]int)
-
 	files, err := ioutil.ReadDir(metricFilePath)
 	if err != nil {
 		return nil, err
 	}
+	return aggregateMetricFiles(metricFilePath, files, defaultMetricFileKey)
+}
+
+// aggregateMetricFiles sums the metrics of the given metric files by the
+// domain parseKey returns for their name, files it does not parse are skipped
+func aggregateMetricFiles(metricFilePath string, files []os.FileInfo, parseKey metricFileKeyParser) (map[string]map[string]int, error) {
+	var m = make(map[string]map[string]int)
+	var fileMap = make(map[string]int)
+
 	if len(files) == 0 {
 		return nil, nil
 	}
 	for _, f := range files {
+		domain, ok := parseKey(f.Name())
+		if !ok {
+			continue
+		}
 		data, err := ioutil.ReadFile(metricFilePath + "/" + f.Name())
 		if err != nil {
 			return nil, fmt.Errorf("Failed to read metric  file : %v, Error:%v", f.Name(), err)
@@ -303,9 +1022,8 @@ func aggregateAllDomainMetrics(metricFilePath string) (map[string]map[string]int
 		if err != nil {
 			return nil, fmt.Errorf("Unmarshalling Error:%v for file : %v", err, f.Name())
 		}
-		domain := strings.Split(f.Name(), "_")
-		if _, exists := m[domain[0]]; exists {
-			domainMap := m[domain[0]]
+		if _, exists := m[domain]; exists {
+			domainMap := m[domain]
 			for key, value := range fileMap {
 				if _, exists := domainMap[key]; exists {
 					val := domainMap[key]
@@ -317,7 +1035,7 @@ func aggregateAllDomainMetrics(metricFilePath string) (map[string]map[string]int
 
 			}
 		} else {
-			m[domain[0]] = fileMap
+			m[domain] = fileMap
 		}
 
 	}
@@ -350,15 +1068,15 @@ func buildDomainMetrics(key string, value map[string]int) (*zts.DomainMetrics, e
 	return data, err
 }
 
-func deleteDomainMetricFiles(path, domainName string) {
+func deleteDomainMetricFiles(path, domainName string, parseKey metricFileKeyParser) {
 	files, err := ioutil.ReadDir(path)
 	if err != nil {
 		log.Printf("Failed to get metric files at path for deletion: %v", path)
 		return
 	}
 	for _, f := range files {
-		domain := strings.Split(f.Name(), "_")
-		if domain[0] == domainName {
+		domain, ok := parseKey(f.Name())
+		if ok && domain == domainName {
 			err := os.Remove(path + "/" + f.Name())
 			if err != nil {
 				log.Printf("Failed to delete file : % v for domain : %v", f.Name(), domainName)
@@ -376,3 +1094,57 @@ func formatUrl(url, suffix string) string {
 	}
 	return url
 }
+
+// newClientTransport returns the transport for the zts and zms clients,
+// every response is checked to be json before it is decoded and signed
+// policy data, with StrictJSONDecode, to have no unknown fields and, with
+// MaxJSONDepth, to be nested no deeper than the limit. Plaintext http is
+// refused unless AllowInsecureHTTP is set.
+func newClientTransport(config *ZpuConfiguration) http.RoundTripper {
+	transport := http.DefaultTransport
+	if config.MinServerKeyBits > 0 {
+		transport = newMinKeyBitsTransport(config.MinServerKeyBits)
+	}
+	if config.AllowInsecureHTTP {
+		log.Printf("Warning: AllowInsecureHTTP is set, policies and public keys may be fetched over plaintext http, never use it outside local development")
+	}
+	transport = &insecureTransport{base: transport, allow: config.AllowInsecureHTTP}
+	if config.SVIDProvider != nil {
+		transport = &svidTransport{base: transport, provider: config.SVIDProvider}
+	}
+	if config.StrictJSONDecode || config.MaxJSONDepth > 0 {
+		transport = &policyDecodeTransport{base: transport, strict: config.StrictJSONDecode, maxDepth: config.MaxJSONDepth}
+	}
+	if config.DomainShardResolver != nil {
+		transport = &shardTransport{base: transport, resolver: config.DomainShardResolver}
+	}
+	return &contentTypeTransport{base: transport}
+}
+
+// zpuClients are the zts and zms clients of a run. They share one transport
+// so the policy, public key and metrics requests reuse the same connections.
+type zpuClients struct {
+	transport http.RoundTripper
+	zts       zts.ZTSClient
+	zms       zms.ZMSClient
+}
+
+// buildClients returns the clients of the configured zts and zms, every
+// client of a run is built here
+func buildClients(config *ZpuConfiguration) *zpuClients {
+	transport := newClientTransport(config)
+	return &zpuClients{
+		transport: transport,
+		zts:       zts.NewClient(formatUrl(config.Zts, "zts/v1"), transport),
+		zms:       zms.NewClient(formatUrl(config.Zms, "zms/v1"), transport),
+	}
+}
+
+// metricsPoster returns the poster of the domain metrics, the zts client
+// unless MetricsEndpoints are configured
+func (clients *zpuClients) metricsPoster(config *ZpuConfiguration) domainMetricsPoster {
+	if len(config.MetricsEndpoints) > 0 {
+		return newMetricsEndpoints(config.MetricsEndpoints, clients.transport, config.MetricsRequireAllEndpoints)
+	}
+	return clients.zts
+}
@@ -4,11 +4,19 @@
 package zpu
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -34,6 +42,7 @@ const (
 var testConfig *ZpuConfiguration
 var ztsClient zts.ZTSClient
 var port string
+var testPrivateKey, testPublicKey string
 
 func TestMain(m *testing.M) {
 
@@ -72,6 +81,126 @@ func TestWritePolicies(t *testing.T) {
 	a.Nil(err)
 }
 
+func TestWritePoliciesFanOut(t *testing.T) {
+	a := assert.New(t)
+	policyData, _, err := ztsClient.GetDomainSignedPolicyData(zts.DomainName(DOMAIN), "")
+	a.Nil(err)
+	fanOutDir := POLICIES_DIR + "_fanout"
+	err = os.MkdirAll(fanOutDir, 0755)
+	require.Nil(t, err)
+	defer os.RemoveAll(fanOutDir)
+
+	config := *testConfig
+	config.PolicyFileDirs = []string{fanOutDir}
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	a.Nil(err)
+	policyFile := fmt.Sprintf("%s/%s.pol", POLICIES_DIR, DOMAIN)
+	defer os.Remove(policyFile)
+	data, err := ioutil.ReadFile(policyFile)
+	a.Nil(err)
+	fanOutData, err := ioutil.ReadFile(fmt.Sprintf("%s/%s.pol", fanOutDir, DOMAIN))
+	a.Nil(err)
+	a.Equal(string(data), string(fanOutData), "Every directory receives the same policy file")
+	a.Equal(util.Exists(fmt.Sprintf("%s/%s.1.tmp", TEMP_POLICIES_DIR, DOMAIN)), false)
+
+	//a directory that cannot be written fails the write
+	os.Remove(policyFile)
+	config.PolicyFileDirs = []string{fanOutDir + "/missing"}
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	a.NotNil(err)
+	a.Equal(util.Exists(policyFile), false, "No directory is written when one cannot be")
+	a.Equal(util.Exists(fmt.Sprintf("%s/%s.1.tmp", TEMP_POLICIES_DIR, DOMAIN)), false)
+	a.Equal(util.Exists(fmt.Sprintf("%s/%s.tmp", TEMP_POLICIES_DIR, DOMAIN)), false)
+
+	config.BatchFsync = true
+	_, err = UpdatePolicies(&config)
+	a.NotNil(err)
+
+	//only the PolicyFileDir would be verified and restored
+	config.BatchFsync = false
+	config.VerifyAfterWrite = true
+	config.PolicyFileDirs = []string{fanOutDir}
+	_, err = UpdatePolicies(&config)
+	a.NotNil(err)
+	a.Equal("PolicyFileDirs is not supported with VerifyAfterWrite", err.Error())
+}
+
+func TestWritePoliciesRetries(t *testing.T) {
+	a := assert.New(t)
+	policyData, _, err := ztsClient.GetDomainSignedPolicyData(zts.DomainName(DOMAIN), "")
+	a.Nil(err)
+	policyFile := fmt.Sprintf("%s/%s.pol", POLICIES_DIR, DOMAIN)
+	defer os.Remove(policyFile)
+
+	failures := 1
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	syncFile = func(file *os.File) error {
+		if failures > 0 {
+			failures--
+			return syscall.EIO
+		}
+		return file.Sync()
+	}
+	clock := newFakeClock(time.Now())
+	config := *testConfig
+	config.Clock = clock
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	a.NotNil(err, "Failures are not retried by default")
+
+	failures = 1
+	config.WriteRetries = 2
+	config.WriteRetryBackoff = time.Second
+	start := clock.Now()
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	a.Nil(err, "The transient failure is retried")
+	a.Equal(util.Exists(policyFile), true)
+	a.Equal(time.Second, clock.Since(start))
+
+	//permission errors are final
+	failures = 0
+	attempts := 0
+	err = retryWrite(&config, "write", func() error {
+		attempts++
+		return os.ErrPermission
+	})
+	a.NotNil(err)
+	a.Equal(1, attempts)
+}
+
+func TestPolicyFilePathIsDirectory(t *testing.T) {
+	a := assert.New(t)
+	policyData, _, err := ztsClient.GetDomainSignedPolicyData(zts.DomainName(DOMAIN), "")
+	a.Nil(err)
+	policyFile := fmt.Sprintf("%s/%s.pol", POLICIES_DIR, DOMAIN)
+	require.Nil(t, os.MkdirAll(policyFile+"/stray", 0755))
+	defer os.RemoveAll(policyFile)
+
+	config := *testConfig
+	zmsClient := zms.NewClient(config.Zms, nil)
+	_, err = GetEtagForExistingPolicy(&config, zmsClient, DOMAIN, POLICIES_DIR)
+	a.IsType(&PolicyPathIsDirectoryError{}, err)
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	var dirErr *PolicyPathIsDirectoryError
+	a.True(errors.As(err, &dirErr))
+	a.Equal(policyFile, dirErr.Path)
+	a.True(strings.Contains(err.Error(), "is a directory"))
+	a.Equal(util.Exists(fmt.Sprintf("%s/%s.tmp", TEMP_POLICIES_DIR, DOMAIN)), false)
+
+	a.Equal(PLAN_FAIL, planDomain(&config, DOMAIN, POLICIES_DIR).Action)
+
+	//only the write removes the stray directory
+	config.RemoveStrayPolicyDirs = true
+	_, err = GetEtagForExistingPolicy(&config, zmsClient, DOMAIN, POLICIES_DIR)
+	a.IsType(&PolicyPathIsDirectoryError{}, err)
+	a.Equal(PLAN_FULL_FETCH, planDomain(&config, DOMAIN, POLICIES_DIR).Action)
+	a.Equal(util.Exists(policyFile+"/stray"), true, "Reading the policy file leaves the stray directory")
+	err = WritePolicies(&config, policyData, DOMAIN, POLICIES_DIR)
+	a.Nil(err)
+	info, err := os.Stat(policyFile)
+	a.Nil(err)
+	a.False(info.IsDir(), "The policy file replaces the stray directory")
+}
+
 func TestGetEtagForExistingPolicy(t *testing.T) {
 	a := assert.New(t)
 	zmsClient := zms.NewClient((*testConfig).Zms, nil)
@@ -256,15 +385,28 @@ func TestDeleteDomainFiles(t *testing.T) {
 	a.Nil(err)
 	err = ioutil.WriteFile(METRIC_DIR+"/test2_000.json", []byte("test"), 0755)
 	a.Nil(err)
-	deleteDomainMetricFiles(METRIC_DIR, "test")
+	deleteDomainMetricFiles(METRIC_DIR, "test", defaultMetricFileKey)
 	a.Equal(util.Exists(METRIC_DIR+"/test_000.json"), false)
 	a.Equal(util.Exists(METRIC_DIR+"/test_001.json"), false)
 	a.Equal(util.Exists(METRIC_DIR+"/test1_000.json"), true)
 	a.Equal(util.Exists(METRIC_DIR+"/test2_000.json"), true)
-	deleteDomainMetricFiles(METRIC_DIR, "test1")
+	deleteDomainMetricFiles(METRIC_DIR, "test1", defaultMetricFileKey)
 	a.Equal(util.Exists(METRIC_DIR+"/test1_000.json"), false)
-	deleteDomainMetricFiles(METRIC_DIR, "test2")
+	deleteDomainMetricFiles(METRIC_DIR, "test2", defaultMetricFileKey)
 	a.Equal(util.Exists(METRIC_DIR+"/test2_000.json"), false)
+
+	err = ioutil.WriteFile(METRIC_DIR+"/test_api_000.json", []byte("test"), 0755)
+	a.Nil(err)
+	err = ioutil.WriteFile(METRIC_DIR+"/test_000.json", []byte("test"), 0755)
+	a.Nil(err)
+	config := &ZpuConfiguration{MetricFileKeyParser: func(filename string) (string, bool) {
+		i := strings.LastIndex(filename, "_")
+		return filename[:i], i > 0
+	}}
+	deleteDomainMetricFiles(METRIC_DIR, "test_api", config.metricFileKey())
+	a.Equal(util.Exists(METRIC_DIR+"/test_api_000.json"), false, "The files are matched with the configured parser")
+	a.Equal(util.Exists(METRIC_DIR+"/test_000.json"), true)
+	os.Remove(METRIC_DIR + "/test_000.json")
 }
 
 func TestPostAllDomainMetric(t *testing.T) {
@@ -289,6 +431,287 @@ func TestPostAllDomainMetric(t *testing.T) {
 	require.Nil(t, err, "No metric files to read")
 }
 
+func TestValidateSignedPoliciesVerifyTimeout(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	config := getSigningConfiguration()
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+
+	release := make(chan struct{})
+	defer func() { verifySignature = verify }()
+	verifySignature = func(input, signature, publicKey string) error {
+		<-release
+		return verify(input, signature, publicKey)
+	}
+	config.VerifyTimeout = 50 * time.Millisecond
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	close(release)
+	var timeoutErr *VerifyTimeoutError
+	a.True(errors.As(err, &timeoutErr))
+	a.Equal(50*time.Millisecond, timeoutErr.Timeout)
+
+	//a verification within the timeout succeeds
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err)
+}
+
+func TestValidateSignedPoliciesExpiresBeforeModified(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	config := getSigningConfiguration()
+
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now.Add(2*time.Hour), now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err)
+	_, ok := err.(*InvalidExpiryError)
+	a.Equal(ok, true, "Expires before modified should return an InvalidExpiryError")
+
+	data, err = signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "Expires after modified should be valid")
+}
+
+func TestValidateSignedPoliciesFutureModified(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	config := getSigningConfiguration()
+
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now.Add(48*time.Hour), now.Add(72*time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "The modified time is not checked without a skew")
+
+	config.MaxFutureModifiedSkew = time.Hour
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.IsType(&FutureModifiedError{}, err)
+
+	data, err = signPolicyData(DOMAIN, now.Add(30*time.Minute), now.Add(72*time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "A modified time within the skew is accepted")
+}
+
+func TestValidateSignedPoliciesIdenticalSignerKeys(t *testing.T) {
+	a := assert.New(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	config := getSigningConfiguration()
+
+	now := time.Now()
+	data, err := testPolicySigner("0", "0").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "Warning:"), "Identical key ids are not reported unless configured")
+
+	config.WarnIdenticalSignerKeys = true
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "Identical key ids only log a warning")
+	a.True(strings.Contains(logs.String(), `Warning: the zts and zms signatures both use the key id:"0"`))
+}
+
+func TestValidateSignedPoliciesCanonicalFunc(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+
+	calls := []string{}
+	config := getSigningConfiguration()
+	config.CanonicalFunc = func(obj interface{}) (string, error) {
+		calls = append(calls, fmt.Sprintf("%T", obj))
+		return util.ToCanonicalString(obj)
+	}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err)
+	a.Equal([]string{"*zts.SignedPolicyData", "*zts.PolicyData"}, calls)
+
+	config.CanonicalFunc = func(obj interface{}) (string, error) {
+		return "{}", nil
+	}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "Verification should use the custom canonical form")
+}
+
+func TestPolicyUpdaterReadOnlyUntil(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("readonly", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"readonly": data})
+	defer server.Close()
+	defer removePolicyFiles("readonly")
+
+	config := getServerConfiguration(server, "readonly")
+	config.ReadOnlyUntil = now.Add(time.Hour)
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal(result.ReadOnly, true)
+	a.Equal([]string{"readonly"}, server.RequestedDomains())
+	a.Equal(util.Exists(POLICIES_DIR+"/readonly.pol"), false, "No policy file should be written in read-only mode")
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/readonly.tmp"), false)
+
+	config.ReadOnlyUntil = now.Add(-time.Hour)
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal(result.ReadOnly, false)
+	a.Equal(util.Exists(POLICIES_DIR+"/readonly.pol"), true)
+}
+
+func TestGetPoliciesRollbackProtection(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	stored, err := signPolicyData("rollback", now, now.Add(2*time.Hour))
+	require.Nil(t, err)
+	older, err := signPolicyData("rollback", now.Add(-time.Hour), now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"rollback": older})
+	defer server.Close()
+	defer removePolicyFiles("rollback")
+
+	config := getServerConfiguration(server, "rollback")
+	err = WritePolicies(config, stored, "rollback", POLICIES_DIR)
+	require.Nil(t, err)
+	storedJson, err := ioutil.ReadFile(POLICIES_DIR + "/rollback.pol")
+	require.Nil(t, err)
+	zmsClient := zms.NewClient(server.URL, nil)
+	ztsClient := zts.NewClient(server.URL+"/zts/v1", nil)
+
+	//conditional fetch, zts ignores the etag and returns older data
+	_, err = getPolicies(config, ztsClient, zmsClient, POLICIES_DIR, "rollback", &runState{})
+	a.IsType(&PolicyRollbackError{}, err, "Older data on a conditional fetch should be a rollback")
+
+	//full fetch, the stored policies were modified by the transform
+	marker := modifiedMarkerFile(POLICIES_DIR + "/rollback.pol")
+	require.Nil(t, ioutil.WriteFile(marker, []byte{}, 0644))
+	defer os.Remove(marker)
+	require.Equal(t, PLAN_FULL_FETCH, planDomain(config, "rollback", POLICIES_DIR).Action)
+	_, err = getPolicies(config, ztsClient, zmsClient, POLICIES_DIR, "rollback", &runState{})
+	a.IsType(&PolicyRollbackError{}, err, "Older data on a full fetch should be a rollback")
+	data, err := ioutil.ReadFile(POLICIES_DIR + "/rollback.pol")
+	a.Nil(err)
+	a.Equal(string(storedJson), string(data), "Stored policies should not be replaced")
+}
+
+func TestWritePoliciesHardlinkStrategy(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.WriteStrategy = WRITE_STRATEGY_HARDLINK
+	a.Nil(verifyWriteStrategy(config, POLICIES_DIR))
+	a.Equal(util.Exists(POLICIES_DIR+"/.zpu_write_probe"), false, "Probe file should be removed")
+	defer removePolicyFiles("hardlink")
+
+	for i := 0; i < 2; i++ {
+		data, err := signPolicyData("hardlink", now.Add(time.Duration(i)*time.Minute), now.Add(time.Hour))
+		require.Nil(t, err)
+		policyJson, err := json.Marshal(data)
+		require.Nil(t, err)
+		err = WritePolicies(config, data, "hardlink", POLICIES_DIR)
+		a.Nil(err)
+		stored, err := ioutil.ReadFile(POLICIES_DIR + "/hardlink.pol")
+		a.Nil(err)
+		a.Equal(string(policyJson), string(stored))
+		a.Equal(util.Exists(TEMP_POLICIES_DIR+"/hardlink.tmp"), false)
+	}
+
+	//a failed link keeps the previous policy file
+	stored, err := ioutil.ReadFile(POLICIES_DIR + "/hardlink.pol")
+	require.Nil(t, err)
+	defer func(link func(string, string) error) { linkFile = link }(linkFile)
+	linkFile = func(oldname, newname string) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EXDEV}
+	}
+	data, err := signPolicyData("hardlink", now.Add(time.Hour), now.Add(2*time.Hour))
+	require.Nil(t, err)
+	a.NotNil(WritePolicies(config, data, "hardlink", POLICIES_DIR))
+	current, err := ioutil.ReadFile(POLICIES_DIR + "/hardlink.pol")
+	a.Nil(err, "The previous policy file is still there")
+	a.Equal(string(stored), string(current))
+	a.Equal(util.Exists(POLICIES_DIR+"/hardlink.pol.link"), false)
+
+	config.WriteStrategy = "copy"
+	a.NotNil(verifyWriteStrategy(config, POLICIES_DIR))
+	config.DomainList = "hardlink"
+	a.NotNil(PolicyUpdater(config), "Unknown write strategy should fail at start up")
+}
+
+func TestValidateSignedPoliciesAllowedZtsIdentities(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZtsKeysmap = map[string]string{"zts.prod": testPublicKey, "zts.other": testPublicKey}
+	config.AllowedZtsIdentities = []string{"zts.prod"}
+
+	data, err := testPolicySigner("zts.other", "0").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClientForTest(), data)
+	a.IsType(&UntrustedZtsIdentityError{}, err)
+
+	data, err = testPolicySigner("zts.prod", "0").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClientForTest(), data)
+	a.Nil(err)
+}
+
+func TestValidateSignedPoliciesDomainKeyIds(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{"zms.1": testPublicKey, "zms.2": testPublicKey}
+	config.DomainKeyIds = map[string]string{DOMAIN: "zms.1"}
+
+	data, err := testPolicySigner("0", "zms.1").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	a.Nil(ValidateSignedPolicies(config, zmsClientForTest(), data))
+
+	data, err = testPolicySigner("0", "zms.2").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	err = ValidateSignedPolicies(config, zmsClientForTest(), data)
+	a.IsType(&UnexpectedZmsKeyIdError{}, err)
+
+	data, err = testPolicySigner("0", "zms.2").Sign("unmapped", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	a.Nil(ValidateSignedPolicies(config, zmsClientForTest(), data), "Domains without an expected key id accept any key")
+}
+
+func TestStartUpDelayDominatesValidity(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("startup", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	defer removePolicyFiles("startup")
+	require.Nil(t, WritePolicies(config, data, "startup", POLICIES_DIR))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config.StartUpDelay = 1800
+	_, err = GetEtagForExistingPolicy(config, zmsClientForTest(), "startup", POLICIES_DIR)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "StartUpDelay"), "Half of the validity is accepted")
+
+	config.StartUpDelay = MAX_STARTUP_DELAY
+	etag, err := GetEtagForExistingPolicy(config, zmsClientForTest(), "startup", POLICIES_DIR)
+	a.Nil(err)
+	a.NotEqual("", etag)
+	a.True(strings.Contains(logs.String(), "Warning: StartUpDelay of 24h0m0s exceeds"))
+
+	config.StrictStartUpDelay = true
+	_, err = GetEtagForExistingPolicy(config, zmsClientForTest(), "startup", POLICIES_DIR)
+	a.IsType(&StartUpDelayError{}, err)
+}
+
 func TestFormatUrl(t *testing.T) {
 	a := assert.New(t)
 	url := formatUrl("ztsUrl/", "zts/v1")
@@ -321,7 +744,7 @@ func setUp() error {
 		return fmt.Errorf("Failed to create directory for metric files, Error:%v", err)
 	}
 	ztsClient = zts.NewClient((*testConfig).Zts, nil)
-	return nil
+	return generateTestKeys()
 }
 
 func cleanUp() error {
@@ -359,5 +782,135 @@ func getTestConfiguration() (*ZpuConfiguration, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to return test configuration object, Error:%v", err)
 	}
+	//the test servers are plaintext
+	config.AllowInsecureHTTP = true
 	return config, nil
 }
+
+func generateTestKeys() error {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return fmt.Errorf("Failed to generate test key, Error:%v", err)
+	}
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal test public key, Error:%v", err)
+	}
+	testPrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	testPublicKey = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicKey}))
+	return nil
+}
+
+// getSigningConfiguration returns a copy of the test configuration which
+// trusts the generated test key for zts and zms key id "0"
+func getSigningConfiguration() *ZpuConfiguration {
+	config := *testConfig
+	config.ZtsKeysmap = map[string]string{"0": testPublicKey}
+	config.ZmsKeysmap = map[string]string{"0": testPublicKey}
+	return &config
+}
+
+func signPolicyData(domain string, modified, expires time.Time) (*zts.DomainSignedPolicyData, error) {
+	return testPolicySigner("0", "0").Sign(domain, modified, expires)
+}
+
+// testPolicySigner signs policy data with the generated test key for the
+// zts and zms key ids
+func testPolicySigner(ztsKeyId, zmsKeyId string) *devel.PolicySigner {
+	return &devel.PolicySigner{PrivateKey: testPrivateKey, ZtsKeyId: ztsKeyId, ZmsKeyId: zmsKeyId}
+}
+
+// startPolicyServer starts a devel.PolicyServer serving the policies with
+// the generated test key
+func startPolicyServer(policies map[string]*zts.DomainSignedPolicyData) *devel.PolicyServer {
+	return devel.StartPolicyServer(testPublicKey, policies)
+}
+
+// getServerConfiguration returns a signing configuration pointing at the
+// given mock server for the given domains
+func getServerConfiguration(server *devel.PolicyServer, domains string) *ZpuConfiguration {
+	config := getSigningConfiguration()
+	config.Zts = server.URL
+	config.Zms = server.URL
+	config.DomainList = domains
+	config.PolicyFileDir = POLICIES_DIR
+	config.MetricsDir = ""
+	return config
+}
+
+func removePolicyFiles(domains ...string) {
+	for _, domain := range domains {
+		os.Remove(fmt.Sprintf("%s/%s.pol", POLICIES_DIR, domain))
+	}
+}
+
+func zmsClientForTest() zms.ZMSClient {
+	return zms.NewClient((*testConfig).Zms, nil)
+}
+
+func TestUpdatePoliciesEnvironment(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("envdomain", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"envdomain": data})
+	defer server.Close()
+	defer os.RemoveAll(POLICIES_DIR + "/prod")
+	defer os.RemoveAll(POLICIES_DIR + "/staging")
+
+	for _, environment := range []string{"prod", "staging"} {
+		config := getServerConfiguration(server, "envdomain")
+		config.Environment = environment
+		config.ResumeLastRun = true
+		result, err := UpdatePolicies(config)
+		a.Nil(err)
+		a.Equal([]string{"envdomain"}, result.UpdatedDomains, "Each environment fetches its own policies")
+	}
+	a.Equal(util.Exists(POLICIES_DIR+"/prod/envdomain.pol"), true)
+	a.Equal(util.Exists(POLICIES_DIR+"/staging/envdomain.pol"), true)
+	a.Equal(util.Exists(POLICIES_DIR+"/envdomain.pol"), false)
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/prod/envdomain.tmp"), false)
+
+	config := getServerConfiguration(server, "envdomain")
+	config.Environment = "prod"
+	results, err := ValidatePolicyDir(config, zmsClientForTest())
+	a.Nil(err)
+	a.Equal(1, len(results))
+	a.Nil(results["envdomain"])
+
+	config.Environment = "../prod"
+	_, err = UpdatePolicies(config)
+	a.NotNil(err)
+}
+
+func TestRefuseWorldWritablePolicies(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("writable", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"writable": data})
+	defer server.Close()
+	defer removePolicyFiles("writable")
+
+	config := getServerConfiguration(server, "writable")
+	config.RefuseWorldWritablePolicies = true
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	policyFile := POLICIES_DIR + "/writable.pol"
+	require.Nil(t, os.Chmod(policyFile, 0666))
+
+	etag, err := GetEtagForExistingPolicy(config, zmsClientForTest(), "writable", POLICIES_DIR)
+	a.Nil(err)
+	a.Equal("", etag, "A world-writable policy file must not provide an etag")
+
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"writable"}, result.UpdatedDomains, "The policies are fetched again")
+	info, err := os.Stat(policyFile)
+	a.Nil(err)
+	a.Equal(os.FileMode(0), info.Mode().Perm()&0002)
+
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"writable"}, result.NotModifiedDomains)
+}
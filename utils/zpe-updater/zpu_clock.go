@@ -0,0 +1,41 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"time"
+)
+
+// Clock is the source of time of the package, the configuration Clock
+// replaces it so that expiry, debounce and time budgets can be tested
+// without waiting
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	Sleep(d time.Duration)
+}
+
+// SystemClock is the Clock of the time package, used when the configuration
+// has no Clock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (SystemClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (SystemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// GetClock returns the configured Clock, the SystemClock when none is set
+func (config *ZpuConfiguration) GetClock() Clock {
+	if config.Clock == nil {
+		return SystemClock{}
+	}
+	return config.Clock
+}
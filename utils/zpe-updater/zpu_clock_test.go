@@ -0,0 +1,127 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// fakeClock is a Clock that only moves when advanced or slept on
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (clock *fakeClock) Now() time.Time {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	return clock.now
+}
+
+func (clock *fakeClock) Since(t time.Time) time.Duration {
+	return clock.Now().Sub(t)
+}
+
+func (clock *fakeClock) Sleep(d time.Duration) {
+	clock.Advance(d)
+}
+
+func (clock *fakeClock) Advance(d time.Duration) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+	clock.now = clock.now.Add(d)
+}
+
+func TestGetClock(t *testing.T) {
+	a := assert.New(t)
+	config := &ZpuConfiguration{}
+	a.Equal(SystemClock{}, config.GetClock())
+	clock := newFakeClock(time.Now())
+	config.Clock = clock
+	a.Equal(clock, config.GetClock())
+}
+
+func TestFakeClockExpiry(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	clock := newFakeClock(now)
+	config := getSigningConfiguration()
+	config.Clock = clock
+
+	a.Nil(ValidateSignedPolicies(config, zmsClient, data))
+	clock.Sleep(2 * time.Hour)
+	a.NotNil(ValidateSignedPolicies(config, zmsClient, data), "The policies are expired on the clock of the configuration")
+}
+
+func TestFakeClockWriteDebounce(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	current, err := signPolicyData("clockdebounce", now.Add(-time.Hour), now.Add(24*time.Hour))
+	require.Nil(t, err)
+	changed, err := signPolicyData("clockdebounce", now.Add(-time.Minute), now.Add(24*time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"clockdebounce": current})
+	defer server.Close()
+	defer removePolicyFiles("clockdebounce")
+	removePolicyFiles("clockdebounce")
+
+	clock := newFakeClock(now)
+	config := getServerConfiguration(server, "clockdebounce")
+	config.WriteDebounce = time.Hour
+	config.Clock = clock
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+
+	server.SetPolicies("clockdebounce", changed)
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"clockdebounce"}, result.DebouncedDomains)
+	clock.Advance(59 * time.Minute)
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"clockdebounce"}, result.DebouncedDomains)
+	clock.Advance(2 * time.Minute)
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"clockdebounce"}, result.UpdatedDomains, "The change is written once stable for the window")
+}
+
+func TestFakeClockTimeBudget(t *testing.T) {
+	a := assert.New(t)
+	clock := newFakeClock(time.Now())
+	var requests int32
+	//every attempt takes a minute on the clock of the configuration
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		clock.Advance(time.Minute)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 5, PerDomainTimeBudget: 90 * time.Second, Clock: clock}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "clockbudget", "")
+	var budgetErr *DomainTimeBudgetError
+	a.True(errors.As(err, &budgetErr))
+	a.Equal(2, budgetErr.Attempts)
+	a.Equal(int32(2), atomic.LoadInt32(&requests))
+}
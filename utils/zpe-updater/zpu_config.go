@@ -10,7 +10,10 @@ import (
 	"log"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/yahoo/athenz/clients/go/zts"
 	"github.com/yahoo/athenz/libs/go/zmssvctoken"
 	"github.com/yahoo/athenz/utils/zpe-updater/util"
 )
@@ -18,12 +21,30 @@ import (
 const (
 	DEFAULT_STARTUP_DELAY = 0
 	MAX_STARTUP_DELAY     = 86400
+	DEFAULT_RESUME_WINDOW = time.Hour
+	// STARTUP_DELAY_VALIDITY_FRACTION is the share of the validity of stored
+	// policies that the StartUpDelay may reach before it is reported
+	STARTUP_DELAY_VALIDITY_FRACTION  = 0.5
+	DEFAULT_VALIDATE_CONCURRENCY     = 8
+	DEFAULT_POLICY_FILE_EXTENSION    = ".pol"
+	DEFAULT_ETAG_MISMATCH_WARN_AFTER = 3
+)
+
+const (
+	FILTER_PRECEDENCE_DENY  = "deny"
+	FILTER_PRECEDENCE_ALLOW = "allow"
+)
+
+const (
+	WRITE_STRATEGY_RENAME   = "rename"
+	WRITE_STRATEGY_HARDLINK = "hardlink"
 )
 
 type ZpuConfiguration struct {
 	Zts              string
 	Zms              string
 	DomainList       string
+	DomainListFile   string
 	ZpuOwner         string
 	PolicyFileDir    string
 	TmpPolicyFileDir string
@@ -35,6 +56,223 @@ type ZpuConfiguration struct {
 	LogAge           int
 	LogBackups       int
 	LogCompression   bool
+	// ResumeLastRun skips the domains that an interrupted previous run
+	// already updated within the ResumeWindow
+	ResumeLastRun bool
+	ResumeWindow  time.Duration
+	// CanonicalFunc overrides util.ToCanonicalString when building the
+	// signed input of policy data
+	CanonicalFunc func(interface{}) (string, error)
+	// BatchFsync writes all temporary policy files of a run before syncing
+	// the directories once and renaming them into place
+	BatchFsync bool
+	// ReadOnlyUntil declares a maintenance window during which policies are
+	// fetched and validated but never written
+	ReadOnlyUntil time.Time
+	// RefreshIfExpiresWithin skips contacting zts for domains whose stored
+	// policies are valid beyond this window
+	RefreshIfExpiresWithin time.Duration
+	// DryRunPlan returns the fetch plan of the domains without fetching
+	DryRunPlan bool
+	// WriteStrategy moves temporary policy files into place with a rename
+	// (default) or with a hardlink followed by an unlink of the temporary file
+	WriteStrategy string
+	// MaxOpenFiles bounds the number of policy files opened at once while
+	// loading and validating stored policies, zero means unbounded
+	MaxOpenFiles int
+	openFiles    semaphore
+	// AllowedZtsIdentities lists the zts key ids trusted to sign policy
+	// data, policies signed by any other key id are rejected when set
+	AllowedZtsIdentities []string
+	// EventChannel receives the events of a run, sends never block and
+	// events are dropped when the channel is full
+	EventChannel chan<- ZpuEvent
+	// VerifyAfterWrite reads back and validates every written policy file,
+	// restoring the previous policy file when it does not validate
+	VerifyAfterWrite bool
+	// MinServerKeyBits fails the tls handshake with zts and zms servers
+	// whose certificate key is weaker than an rsa key of this size, ec and
+	// ed25519 keys compare by strength, e.g. P-256 as 3072 rsa bits. 0
+	// disables the check
+	MinServerKeyBits int
+	// Environment keeps the policy and temporary files of each zts
+	// environment in its own sub directory, e.g. prod and staging
+	Environment string
+	// PostValidateTransform runs over the validated policy data before it
+	// is written. Changing the data breaks its signatures and is rejected
+	// unless AllowPolicyModification is set.
+	PostValidateTransform   func(*zts.DomainSignedPolicyData) error
+	AllowPolicyModification bool
+	// SVIDProvider returns the JWT-SVID sent as a bearer token on every
+	// zts and zms request, it is called again for each request
+	SVIDProvider func() (string, error)
+	// PrometheusTextfile is the path of the metrics file written after every
+	// run for the node_exporter textfile collector
+	PrometheusTextfile string
+	// RetryCount is the number of times a failed policy fetch is retried,
+	// RetryBackoff apart
+	RetryCount   int
+	RetryBackoff time.Duration
+	// PerDomainTimeBudget caps the time spent fetching the policies of a
+	// single domain across all attempts, 0 means no limit
+	PerDomainTimeBudget time.Duration
+	// RefuseWorldWritablePolicies ignores stored policy files that are, or
+	// whose directory is, world-writable and fetches them again
+	RefuseWorldWritablePolicies bool
+	// MetricsBatchSize groups the domains whose metrics are posted together,
+	// with up to MetricsConcurrency batches posted at the same time
+	MetricsBatchSize   int
+	MetricsConcurrency int
+	// DomainKeyIds maps a domain to the only zms key id allowed to sign
+	// its policies, domains without an entry accept any zms key id
+	DomainKeyIds map[string]string
+	// WriteDebounce delays writing a changed policy file until the fetched
+	// change has been the same for the window across repeated runs of this
+	// configuration, unless the stored policies expire within the window
+	WriteDebounce time.Duration
+	debounce      *debounceState
+	// DomainProviders are consulted after DomainList and DomainListFile,
+	// the domains of all sources are processed
+	DomainProviders []DomainProvider
+	// StrictStartUpDelay fails stored policies whose validity is too short
+	// for the StartUpDelay instead of logging a warning
+	StrictStartUpDelay bool
+	// ValidateConcurrency is the number of policy files ValidatePolicyDir
+	// validates at the same time, DEFAULT_VALIDATE_CONCURRENCY when zero
+	ValidateConcurrency int
+	// SweepTempFiles removes the .tmp files left in the temporary policy
+	// directory by interrupted runs before a run starts
+	SweepTempFiles bool
+	// StrictJSONDecode rejects policy data from zts or stored policy files
+	// with fields unknown to this version
+	StrictJSONDecode bool
+	// PolicyFileDirs are written with every policy file in addition to the
+	// PolicyFileDir, with its modified marker. They are not supported with
+	// BatchFsync or VerifyAfterWrite.
+	PolicyFileDirs []string
+	// VerifyTimeout limits the time spent verifying each signature, no
+	// limit when zero
+	VerifyTimeout time.Duration
+	// DomainShardResolver returns the zts endpoint, as a url or host:port,
+	// expected to serve the policies of the domain. Policies served by any
+	// other endpoint are rejected, "" accepts any endpoint.
+	DomainShardResolver func(domain string) (expectedEndpoint string)
+	// MetricsQueueDepth aggregates the metrics one domain at a time and
+	// holds at most this many domains waiting to be posted, MetricsBatchSize
+	// is not used when set
+	MetricsQueueDepth int
+	// Clock is the source of time, the SystemClock when nil
+	Clock Clock
+	// DetectAlgorithmDowngrade warns when a domain is signed with a weaker
+	// algorithm than the strongest one recorded for it by previous runs
+	DetectAlgorithmDowngrade bool
+	// RunResultWebhook receives a POST of the UpdateResult json at the end of
+	// every run
+	RunResultWebhook string
+	// MaxFutureModifiedSkew rejects policy data modified further than this
+	// in the future, no limit when zero
+	MaxFutureModifiedSkew time.Duration
+	// WriteRetries is the number of times a failed write of a policy file is
+	// retried, WriteRetryBackoff apart
+	WriteRetries      int
+	WriteRetryBackoff time.Duration
+	// PolicyFileExtension is the extension of the policy files,
+	// DEFAULT_POLICY_FILE_EXTENSION when empty
+	PolicyFileExtension string
+	// EtagMismatchWarnAfter is the number of consecutive runs a conditional
+	// fetch may return unchanged policies in full before a warning is logged,
+	// DEFAULT_ETAG_MISMATCH_WARN_AFTER when zero
+	EtagMismatchWarnAfter int
+	// MaxMetricFilesPerRun limits the metric files posted by a run to the
+	// oldest ones, no limit when zero
+	MaxMetricFilesPerRun int
+	// DomainAllowlist limits the resolved domains to the listed ones when
+	// set and the DomainDenylist drops the listed domains. FilterPrecedence,
+	// FILTER_PRECEDENCE_DENY or FILTER_PRECEDENCE_ALLOW, decides a domain in
+	// both lists, the denylist wins when empty.
+	DomainAllowlist  []string
+	DomainDenylist   []string
+	FilterPrecedence string
+	// CheckSigningCertRevocation fails the validation of policies signed by
+	// a zts key whose certificate in ZtsSigningCerts, keyed by key id, is on
+	// the CRL of its distribution point. The CRL must be signed by the
+	// SigningCertIssuer, which is required, and not past its NextUpdate.
+	// OCSP is not supported. Checks are cached for the
+	// SigningCertRevocationTTL, DEFAULT_SIGNING_CERT_REVOCATION_TTL when zero.
+	CheckSigningCertRevocation bool
+	ZtsSigningCerts            map[string]string
+	SigningCertIssuer          string
+	SigningCertRevocationTTL   time.Duration
+	// MetricFileKeyParser returns the domain of a metric file from its name,
+	// or false to skip the file. The default takes the name up to its first
+	// underscore
+	MetricFileKeyParser func(filename string) (domain string, ok bool)
+	// WarnIdenticalSignerKeys logs a warning when the zts and zms signatures
+	// of the policy data use the same key id
+	WarnIdenticalSignerKeys bool
+	// MaxConcurrentKeyFetches bounds the number of public keys fetched from
+	// zms at once by all the workers, zero means unbounded
+	MaxConcurrentKeyFetches int
+	keyFetches              semaphore
+	// RemoveStrayPolicyDirs removes a directory found where a policy file is
+	// written instead of failing the domain with a PolicyPathIsDirectoryError,
+	// the domain is then fetched in full
+	RemoveStrayPolicyDirs bool
+	// ReturnErrorOnPartialFailure makes UpdatePolicies return an error when
+	// some domains failed, true when nil. With false the failures are only
+	// reported in the FailedDomains of the result.
+	ReturnErrorOnPartialFailure *bool
+	// MaxJSONDepth rejects fetched and stored policy data nested deeper than
+	// the number of levels with a JSONDepthError, no limit when zero
+	MaxJSONDepth int
+	// MetricsEndpoints are the zts urls the metrics are posted to instead of
+	// the Zts. The metric files of a domain are deleted once one endpoint,
+	// or every endpoint with MetricsRequireAllEndpoints, accepted them.
+	MetricsEndpoints           []string
+	MetricsRequireAllEndpoints bool
+	// ExpiryAlertThreshold logs an alert and sends a DomainExpiring event for
+	// every domain that failed to refresh while its stored policies expire
+	// within the threshold, no alerts when zero
+	ExpiryAlertThreshold time.Duration
+	// LogSampleThreshold logs only the first domain errors of each category
+	// in a run, the others are counted in a summary at the end of the run,
+	// every error is logged when zero
+	LogSampleThreshold int
+	// StoreServerEtag stores the etag returned by zts next to the policy
+	// file and sends it on the next fetch instead of the etag built from the
+	// modified time of the stored policies
+	StoreServerEtag bool
+	// AllowInsecureHTTP permits plaintext http requests to zts and zms and
+	// retries https requests over http when the server answers in
+	// plaintext, for local development against a zts mock only
+	AllowInsecureHTTP bool
+	// OpaDataDir receives a <domain>.json OPA data document with the
+	// flattened assertions of every written policy file, none when empty.
+	// A missing document of a not modified domain is written from its
+	// stored policy file.
+	OpaDataDir string
+	// AllowedZmsKeyIds lists the zms key ids expected to sign the policies
+	// of every domain, the domains signed by any other key id are reported
+	// in the ForeignSignedDomains of the result when set
+	AllowedZmsKeyIds []string
+	// QuietEmptyMetrics stops logging that there are no metrics to post
+	// when the MetricsDir is empty
+	QuietEmptyMetrics bool
+	// TrustedRootKeys are the PEM public keys the zts and zms signatures
+	// must verify with when set, whatever their key ids, so policies are
+	// validated without the key maps or zms
+	TrustedRootKeys []string
+	// PolicyRedactor masks sensitive names in policy content before it is
+	// logged, the content is logged as is when nil. The RunResultWebhook
+	// carries no policy content.
+	PolicyRedactor func(string) string
+	// lastErrors holds the error of each domain failed by the last runs,
+	// see LastError
+	lastErrors *domainErrors
+	// revocations caches the revocation status of the signing certificates
+	revocations *revocationCache
+	// cacheStats counts the cache lookups, see CacheStats
+	cacheStats *CacheStats
 }
 
 type AthenzConf struct {
@@ -52,6 +290,8 @@ type AthenzConf struct {
 
 type ZpuConf struct {
 	Domains       string `json:"domains"`
+	DomainsFile   string `json:"domainsFile"`
+	Environment   string `json:"environment"`
 	User          string `json:"user"`
 	PolicyDir     string `json:"policyDir"`
 	MetricsDir    string `json:"metricsDir"`
@@ -133,6 +373,8 @@ func NewZpuConfiguration(root, athensConfFile, zpuConfFile, tmpPolicyFileDir str
 		Zts:              athenzConf.ZtsUrl,
 		Zms:              athenzConf.ZmsUrl,
 		DomainList:       zpuConf.Domains,
+		DomainListFile:   zpuConf.DomainsFile,
+		Environment:      zpuConf.Environment,
 		ZpuOwner:         user,
 		PolicyFileDir:    policyDir,
 		TmpPolicyFileDir: tmpPolicyFileDir,
@@ -181,7 +423,7 @@ func ReadZpuConf(zpuConf string) (*ZpuConf, error) {
 	return zConf, nil
 }
 
-func (config ZpuConfiguration) GetZtsPublicKey(key string) string {
+func (config *ZpuConfiguration) GetZtsPublicKey(key string) string {
 	for k := range config.ZtsKeysmap {
 		if k == key {
 			return config.ZtsKeysmap[key]
@@ -190,7 +432,79 @@ func (config ZpuConfiguration) GetZtsPublicKey(key string) string {
 	return ""
 }
 
-func (config ZpuConfiguration) GetZmsPublicKey(key string) string {
+func (config *ZpuConfiguration) isAllowedZtsIdentity(keyId string) bool {
+	if len(config.AllowedZtsIdentities) == 0 {
+		return true
+	}
+	for _, identity := range config.AllowedZtsIdentities {
+		if identity == keyId {
+			return true
+		}
+	}
+	return false
+}
+
+// policyDir returns the policy directory, namespaced by the Environment
+func (config *ZpuConfiguration) policyDir() string {
+	return environmentDir(config.PolicyFileDir, config.Environment)
+}
+
+// policyFileExt returns the extension of the policy files
+func (config *ZpuConfiguration) policyFileExt() string {
+	if config.PolicyFileExtension == "" {
+		return DEFAULT_POLICY_FILE_EXTENSION
+	}
+	return config.PolicyFileExtension
+}
+
+// policyFile returns the policy file of the domain in the directory
+func (config *ZpuConfiguration) policyFile(dir, domain string) string {
+	return fmt.Sprintf("%s/%s%s", dir, domain, config.policyFileExt())
+}
+
+// tmpPolicyDir returns the temporary policy directory, namespaced by the
+// Environment
+func (config *ZpuConfiguration) tmpPolicyDir() string {
+	return environmentDir(config.TmpPolicyFileDir, config.Environment)
+}
+
+func environmentDir(dir, environment string) string {
+	if dir == "" || environment == "" {
+		return dir
+	}
+	return fmt.Sprintf("%s/%s", dir, environment)
+}
+
+// fanOutDirs returns the PolicyFileDirs directories of the environment
+func (config *ZpuConfiguration) fanOutDirs() []string {
+	dirs := make([]string, 0, len(config.PolicyFileDirs))
+	for _, dir := range config.PolicyFileDirs {
+		dirs = append(dirs, environmentDir(dir, config.Environment))
+	}
+	return dirs
+}
+
+// validEnvironment checks that the environment is a single path element
+func validEnvironment(environment string) bool {
+	return environment != "." && environment != ".." && !strings.ContainsAny(environment, "/\\")
+}
+
+// redact returns the policy content as it may be logged
+func (config *ZpuConfiguration) redact(content string) string {
+	if config.PolicyRedactor == nil {
+		return content
+	}
+	return config.PolicyRedactor(content)
+}
+
+func (config *ZpuConfiguration) ToCanonicalString(obj interface{}) (string, error) {
+	if config.CanonicalFunc != nil {
+		return config.CanonicalFunc(obj)
+	}
+	return canonicalString(obj)
+}
+
+func (config *ZpuConfiguration) GetZmsPublicKey(key string) string {
 	for k := range config.ZmsKeysmap {
 		if k == key {
 			return config.ZmsKeysmap[key]
@@ -198,3 +512,72 @@ func (config ZpuConfiguration) GetZmsPublicKey(key string) string {
 	}
 	return ""
 }
+
+// semaphore bounds concurrent access to a resource, a nil semaphore never blocks
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size <= 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+func (s semaphore) acquire() {
+	if s != nil {
+		s <- struct{}{}
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// resized reports whether the semaphore does not have the size, a nil
+// semaphore has any size less than one
+func (s semaphore) resized(size int) bool {
+	if size <= 0 {
+		return s != nil
+	}
+	return cap(s) != size
+}
+
+// initSharedState creates the semaphores and the state kept across runs
+// before the goroutines of a run share the configuration, which then only
+// read it. UpdatePolicies and ValidatePolicyDir create it when they start.
+func (config *ZpuConfiguration) initSharedState() {
+	if config.openFiles.resized(config.MaxOpenFiles) {
+		config.openFiles = newSemaphore(config.MaxOpenFiles)
+	}
+	if config.keyFetches.resized(config.MaxConcurrentKeyFetches) {
+		config.keyFetches = newSemaphore(config.MaxConcurrentKeyFetches)
+	}
+	if config.cacheStats == nil {
+		config.cacheStats = &CacheStats{}
+	}
+	if config.revocations == nil {
+		config.revocations = &revocationCache{entries: make(map[string]revocationStatus)}
+	}
+	if config.lastErrors == nil {
+		config.lastErrors = &domainErrors{errs: make(map[string]error)}
+	}
+	if config.debounce == nil {
+		config.debounce = &debounceState{pending: make(map[string]*pendingChange)}
+	}
+}
+
+func (config *ZpuConfiguration) openFileSemaphore() semaphore {
+	config.initSharedState()
+	return config.openFiles
+}
+
+func (config *ZpuConfiguration) returnErrorOnPartialFailure() bool {
+	return config.ReturnErrorOnPartialFailure == nil || *config.ReturnErrorOnPartialFailure
+}
+
+func (config *ZpuConfiguration) keyFetchSemaphore() semaphore {
+	config.initSharedState()
+	return config.keyFetches
+}
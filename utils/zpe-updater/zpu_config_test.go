@@ -81,11 +81,13 @@ func TestReadZpuConf(t *testing.T) {
 	a.Empty(zpuFile)
 
 	//correct file
-	err = devel.CreateFile(ZPU_CONF, `{"domains":"domain","user":"user","policyDir":"/policy","metricsDir":"/metric","logMaxsize":10,"logMaxage":7,"logMaxbackups":2,"logCompress":true}`)
+	err = devel.CreateFile(ZPU_CONF, `{"domains":"domain","domainsFile":"/domains","environment":"prod","user":"user","policyDir":"/policy","metricsDir":"/metric","logMaxsize":10,"logMaxage":7,"logMaxbackups":2,"logCompress":true}`)
 	a.Nil(err)
 	zpuFile, err = ReadZpuConf(ZPU_CONF)
 	a.Nil(err)
 	a.Equal(zpuFile.Domains, "domain")
+	a.Equal(zpuFile.DomainsFile, "/domains")
+	a.Equal(zpuFile.Environment, "prod")
 	a.Equal(zpuFile.User, "user")
 	a.Equal(zpuFile.PolicyDir, "/policy")
 	a.Equal(zpuFile.MetricsDir, "/metric")
@@ -0,0 +1,241 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// CONTENT_SNIPPET_SIZE is the number of body bytes kept in an
+// UnexpectedContentTypeError for diagnosis
+const CONTENT_SNIPPET_SIZE = 256
+
+// UnexpectedContentTypeError is returned when a successful zts or zms
+// response is not json, e.g. the html error page of a proxy.
+type UnexpectedContentTypeError struct {
+	URL         string
+	ContentType string
+	Snippet     string
+}
+
+func (e *UnexpectedContentTypeError) Error() string {
+	return fmt.Sprintf("Unexpected content type: %q from %v, body: %q", e.ContentType, e.URL, e.Snippet)
+}
+
+// contentTypeTransport rejects successful responses that are not json
+// before the clients try to decode them
+type contentTypeTransport struct {
+	base http.RoundTripper
+}
+
+func (transport *contentTypeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if isJSONContentType(contentType) {
+		return resp, nil
+	}
+	snippet, _ := ioutil.ReadAll(io.LimitReader(resp.Body, CONTENT_SNIPPET_SIZE))
+	resp.Body.Close()
+	return nil, &UnexpectedContentTypeError{URL: req.URL.String(), ContentType: contentType, Snippet: string(snippet)}
+}
+
+// UnknownFieldError is returned with StrictJSONDecode when policy data has
+// a field this version does not know, e.g. after a zts upgrade.
+type UnknownFieldError struct {
+	Source string
+	Field  string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("Unknown field: %v in policy data from %v", e.Field, e.Source)
+}
+
+// JSONDepthError is returned when policy data is nested deeper than the
+// MaxJSONDepth.
+type JSONDepthError struct {
+	Source   string
+	MaxDepth int
+}
+
+func (e *JSONDepthError) Error() string {
+	return fmt.Sprintf("Policy data from %v is nested deeper than %v levels", e.Source, e.MaxDepth)
+}
+
+// decodePolicyData decodes the signed policy data, rejecting unknown fields
+// with an UnknownFieldError when strict and data nested deeper than maxDepth,
+// when set, with a JSONDepthError. The generated zts types unmarshal
+// themselves, so a Decoder with DisallowUnknownFields would not see the
+// nested fields and the raw json is matched against the struct tags instead.
+func decodePolicyData(reader io.Reader, strict bool, maxDepth int, source string) (*zts.DomainSignedPolicyData, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if maxDepth > 0 && jsonDepthExceeded(content, maxDepth) {
+		return nil, &JSONDepthError{Source: source, MaxDepth: maxDepth}
+	}
+	var data *zts.DomainSignedPolicyData
+	err = json.Unmarshal(content, &data)
+	if err != nil {
+		return nil, err
+	}
+	if strict {
+		var raw interface{}
+		err = json.Unmarshal(content, &raw)
+		if err != nil {
+			return nil, err
+		}
+		if field := unknownField(raw, reflect.TypeOf(data), ""); field != "" {
+			return nil, &UnknownFieldError{Source: source, Field: field}
+		}
+	}
+	return data, nil
+}
+
+// jsonDepthExceeded scans the raw json for objects and arrays nested deeper
+// than maxDepth, before any of it is decoded
+func jsonDepthExceeded(content []byte, maxDepth int) bool {
+	depth := 0
+	inString := false
+	escaped := false
+	for _, c := range content {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
+
+// unknownField returns the path of the first json object key in value that
+// has no matching field in the type, "" when every key is known
+func unknownField(value interface{}, t reflect.Type, path string) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if t.Kind() == reflect.Map {
+			for key, elem := range value {
+				if field := unknownField(elem, t.Elem(), path+key+"."); field != "" {
+					return field
+				}
+			}
+			return ""
+		}
+		if t.Kind() != reflect.Struct {
+			return ""
+		}
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldType, ok := jsonFieldType(t, key)
+			if !ok {
+				return path + key
+			}
+			if field := unknownField(value[key], fieldType, path+key+"."); field != "" {
+				return field
+			}
+		}
+	case []interface{}:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return ""
+		}
+		for i, elem := range value {
+			if field := unknownField(elem, t.Elem(), fmt.Sprintf("%v%v.", path, i)); field != "" {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// jsonFieldType returns the type of the struct field encoded with the json
+// key, matched case insensitively as encoding/json does
+func jsonFieldType(t reflect.Type, key string) (reflect.Type, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if strings.EqualFold(name, key) {
+			return field.Type, true
+		}
+	}
+	return nil, false
+}
+
+// policyDecodeTransport checks that the signed policy data returned by zts
+// has no unknown fields when strict and is not nested deeper than maxDepth
+// before the client decodes it
+type policyDecodeTransport struct {
+	base     http.RoundTripper
+	strict   bool
+	maxDepth int
+}
+
+func (transport *policyDecodeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasSuffix(req.URL.Path, "/signed_policy_data") {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	_, err = decodePolicyData(bytes.NewReader(body), transport.strict, transport.maxDepth, req.URL.String())
+	switch err.(type) {
+	case *UnknownFieldError, *JSONDepthError:
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
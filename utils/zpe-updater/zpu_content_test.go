@@ -0,0 +1,142 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestUnexpectedContentType(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body>Proxy login required</body></html>")
+	}))
+	defer server.Close()
+
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(&ZpuConfiguration{AllowInsecureHTTP: true}))
+	_, _, err := ztsClient.GetDomainSignedPolicyData("content", "")
+	var contentErr *UnexpectedContentTypeError
+	a.True(errors.As(err, &contentErr))
+	a.Equal("text/html; charset=utf-8", contentErr.ContentType)
+	a.True(strings.Contains(contentErr.Snippet, "Proxy login required"))
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 2}
+	_, _, err = fetchSignedPolicyData(config, ztsClient, "content", "")
+	a.NotNil(err)
+	a.Equal(int32(2), atomic.LoadInt32(&requests), "Unexpected content is not retried")
+}
+
+func TestIsJSONContentType(t *testing.T) {
+	a := assert.New(t)
+	a.True(isJSONContentType("application/json"))
+	a.True(isJSONContentType("application/json; charset=utf-8"))
+	a.True(isJSONContentType("application/jwk-set+json"))
+	a.False(isJSONContentType("text/html"))
+	a.False(isJSONContentType("text/plain; charset=utf-8"))
+	a.False(isJSONContentType(""))
+}
+
+func TestStrictJSONDecode(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("strict", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	encoded, err := json.Marshal(data)
+	require.Nil(t, err)
+	extra := strings.Replace(string(encoded), "{", `{"newField":"value",`, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, extra)
+	}))
+	defer server.Close()
+
+	//lenient decoding ignores the unknown field
+	config := &ZpuConfiguration{AllowInsecureHTTP: true}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(config))
+	fetched, _, err := fetchSignedPolicyData(config, ztsClient, "strict", "")
+	a.Nil(err)
+	a.NotNil(fetched)
+
+	config = &ZpuConfiguration{AllowInsecureHTTP: true, StrictJSONDecode: true, RetryCount: 2}
+	ztsClient = zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(config))
+	_, _, err = fetchSignedPolicyData(config, ztsClient, "strict", "")
+	var fieldErr *UnknownFieldError
+	a.True(errors.As(err, &fieldErr))
+	a.Equal("newField", fieldErr.Field)
+
+	//stored policy files are decoded the same way
+	policyFile := TEMP_POLICIES_DIR + "/strict.pol"
+	err = ioutil.WriteFile(policyFile, []byte(extra), 0644)
+	require.Nil(t, err)
+	defer os.Remove(policyFile)
+	_, err = readPolicyFile(&ZpuConfiguration{}, policyFile)
+	a.Nil(err)
+	_, err = readPolicyFile(&ZpuConfiguration{StrictJSONDecode: true}, policyFile)
+	a.IsType(&UnknownFieldError{}, err)
+
+	//nested unknown fields are found as well
+	nested := strings.Replace(string(encoded), `"policyData":{`, `"policyData":{"newField":"value",`, 1)
+	_, err = decodePolicyData(strings.NewReader(nested), false, 0, "nested")
+	a.Nil(err)
+	_, err = decodePolicyData(strings.NewReader(nested), true, 0, "nested")
+	a.True(errors.As(err, &fieldErr))
+	a.Equal("signedPolicyData.policyData.newField", fieldErr.Field)
+	_, err = decodePolicyData(strings.NewReader(string(encoded)), true, 0, "signed")
+	a.Nil(err)
+}
+
+func TestMaxJSONDepth(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("deep", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	encoded, err := json.Marshal(data)
+	require.Nil(t, err)
+	deep := `{"signedPolicyData":{"policyData":{"domain":"deep","policies":[` + strings.Repeat("[", 10000) + strings.Repeat("]", 10000) + `]}}}`
+	var served int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&served, 1)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, deep)
+	}))
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, MaxJSONDepth: 32, RetryCount: 2}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(config))
+	_, _, err = fetchSignedPolicyData(config, ztsClient, "deep", "")
+	var depthErr *JSONDepthError
+	a.True(errors.As(err, &depthErr))
+	a.Equal(32, depthErr.MaxDepth)
+	a.Equal(int32(1), atomic.LoadInt32(&served), "Deeply nested data is not retried")
+
+	policyFile := TEMP_POLICIES_DIR + "/deep.pol"
+	require.Nil(t, ioutil.WriteFile(policyFile, []byte(deep), 0644))
+	defer os.Remove(policyFile)
+	_, err = readPolicyFile(config, policyFile)
+	a.IsType(&JSONDepthError{}, err)
+
+	//brackets in strings are not counted
+	quoted := strings.Replace(string(encoded), `"policyData":{`, `"policyData":{"domain":"`+strings.Repeat(`{[\"`, 100)+`",`, 1)
+	a.False(jsonDepthExceeded([]byte(quoted), 32))
+	_, err = decodePolicyData(strings.NewReader(string(encoded)), false, 32, "signed")
+	a.Nil(err, "Policy data within the limit is decoded")
+	a.True(jsonDepthExceeded(encoded, 3))
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// debounceState remembers the policy change pending for each domain across
+// the runs of a configuration, as when UpdatePolicies runs in a loop
+type debounceState struct {
+	mutex   sync.Mutex
+	pending map[string]*pendingChange
+}
+
+type pendingChange struct {
+	modified string
+	seen     time.Time
+}
+
+func (config *ZpuConfiguration) debounceState() *debounceState {
+	config.initSharedState()
+	return config.debounce
+}
+
+// shouldWrite reports whether the fetched change of the domain has been
+// stable for the WriteDebounce window. The write is never delayed when there
+// is no usable stored policy file or the stored policies expire within the
+// window.
+func (state *debounceState) shouldWrite(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain, policyFileDir string) (bool, string) {
+	now := config.GetClock().Now()
+	policyFile := config.policyFile(policyFileDir, domain)
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if !util.Exists(policyFile) {
+		delete(state.pending, domain)
+		return true, "no stored policy file"
+	}
+	stored, err := readPolicyFile(config, policyFile)
+	if err != nil {
+		delete(state.pending, domain)
+		return true, "stored policies are not usable"
+	}
+	if stored.SignedPolicyData.Expires.Time.Before(now.Add(config.WriteDebounce)) {
+		delete(state.pending, domain)
+		return true, "stored policies expire within the debounce window"
+	}
+	modified := data.SignedPolicyData.Modified.String()
+	pending := state.pending[domain]
+	if pending == nil || pending.modified != modified {
+		state.pending[domain] = &pendingChange{modified: modified, seen: now}
+		return false, fmt.Sprintf("change modified on %v is new", modified)
+	}
+	if now.Sub(pending.seen) < config.WriteDebounce {
+		return false, fmt.Sprintf("change modified on %v is stable since %v", modified, pending.seen)
+	}
+	delete(state.pending, domain)
+	return true, fmt.Sprintf("change modified on %v is stable for the debounce window", modified)
+}
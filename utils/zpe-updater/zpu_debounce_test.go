@@ -0,0 +1,79 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestWriteDebounce(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	versions := []*zts.DomainSignedPolicyData{}
+	for i := 3; i > 0; i-- {
+		data, err := signPolicyData("debounce", now.Add(-time.Duration(i)*time.Minute), now.Add(time.Hour))
+		require.Nil(t, err)
+		versions = append(versions, data)
+	}
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"debounce": versions[0]})
+	defer server.Close()
+	defer removePolicyFiles("debounce")
+	removePolicyFiles("debounce")
+
+	config := getServerConfiguration(server, "debounce")
+	config.WriteDebounce = 200 * time.Millisecond
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"debounce"}, result.UpdatedDomains, "The first policy file is written without delay")
+
+	writes := 0
+	for _, version := range versions[1:] {
+		server.SetPolicies("debounce", version)
+		for i := 0; i < 2; i++ {
+			result, err = UpdatePolicies(config)
+			a.Nil(err)
+			writes += len(result.UpdatedDomains)
+			a.Equal([]string{"debounce"}, result.DebouncedDomains)
+		}
+	}
+	a.Equal(0, writes, "Rapid changes are not written")
+
+	time.Sleep(250 * time.Millisecond)
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"debounce"}, result.UpdatedDomains, "The settled change is written once")
+	stored, err := readPolicyFile(config, POLICIES_DIR+"/debounce.pol")
+	a.Nil(err)
+	a.Equal(versions[2].SignedPolicyData.Modified.String(), stored.SignedPolicyData.Modified.String())
+
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"debounce"}, result.NotModifiedDomains)
+}
+
+func TestWriteDebounceForcedOnExpiry(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	expiring, err := signPolicyData("debounce2", now.Add(-time.Minute), now.Add(time.Minute))
+	require.Nil(t, err)
+	changed, err := signPolicyData("debounce2", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"debounce2": expiring})
+	defer server.Close()
+	defer removePolicyFiles("debounce2")
+
+	config := getServerConfiguration(server, "debounce2")
+	config.WriteDebounce = time.Hour
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	server.SetPolicies("debounce2", changed)
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"debounce2"}, result.UpdatedDomains, "Stored policies expiring within the window are replaced at once")
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// PolicyDiff lists the differences between the stored policies of a domain
+// and the policies zts currently serves for it
+type PolicyDiff struct {
+	Domain          string `json:"domain"`
+	StoredModified  string `json:"storedModified"`
+	FetchedModified string `json:"fetchedModified"`
+	// Identical is set when the canonical forms of the stored and fetched
+	// signed policy data are the same
+	Identical bool `json:"identical"`
+	// AddedPolicies and AddedAssertions are only in the fetched policies,
+	// RemovedPolicies and RemovedAssertions only in the stored ones
+	AddedPolicies     []string `json:"addedPolicies"`
+	RemovedPolicies   []string `json:"removedPolicies"`
+	AddedAssertions   []string `json:"addedAssertions"`
+	RemovedAssertions []string `json:"removedAssertions"`
+}
+
+// CompareStoredToFetched fetches the policies of the domain from zts and
+// compares them with the stored policy file, without validating or writing
+// anything. It is meant to diagnose a ZPE seeing other policies than zts,
+// every difference is logged through the PolicyRedactor.
+func CompareStoredToFetched(config *ZpuConfiguration, domain string) (*PolicyDiff, error) {
+	if config == nil {
+		return nil, errors.New("Nil configuration")
+	}
+	if config.Zts == "" {
+		return nil, errors.New("Empty Zts url in configuration")
+	}
+	stored, err := readPolicyFile(config, config.policyFile(config.policyDir(), domain))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read stored policies of domain: %v, Error:%v", domain, err)
+	}
+	ztsClient := buildClients(config).zts
+	fetched, _, err := fetchSignedPolicyData(config, ztsClient, domain, "")
+	if err != nil {
+		return nil, err
+	}
+	if fetched == nil || fetched.SignedPolicyData == nil {
+		return nil, fmt.Errorf("Empty policies data returned for domain: %v", domain)
+	}
+	diff := &PolicyDiff{
+		Domain:          domain,
+		StoredModified:  stored.SignedPolicyData.Modified.String(),
+		FetchedModified: fetched.SignedPolicyData.Modified.String(),
+	}
+	storedForm, err := config.ToCanonicalString(stored.SignedPolicyData)
+	if err != nil {
+		return nil, err
+	}
+	fetchedForm, err := config.ToCanonicalString(fetched.SignedPolicyData)
+	if err != nil {
+		return nil, err
+	}
+	diff.Identical = storedForm == fetchedForm
+	storedPolicies, storedAssertions := policyEntries(stored)
+	fetchedPolicies, fetchedAssertions := policyEntries(fetched)
+	diff.AddedPolicies = missingEntries(fetchedPolicies, storedPolicies)
+	diff.RemovedPolicies = missingEntries(storedPolicies, fetchedPolicies)
+	diff.AddedAssertions = missingEntries(fetchedAssertions, storedAssertions)
+	diff.RemovedAssertions = missingEntries(storedAssertions, fetchedAssertions)
+	logDiffEntries(config, domain, "policy", "added to", diff.AddedPolicies)
+	logDiffEntries(config, domain, "policy", "removed from", diff.RemovedPolicies)
+	logDiffEntries(config, domain, "assertion", "added to", diff.AddedAssertions)
+	logDiffEntries(config, domain, "assertion", "removed from", diff.RemovedAssertions)
+	return diff, nil
+}
+
+func logDiffEntries(config *ZpuConfiguration, domain, kind, change string, entries []string) {
+	for _, entry := range entries {
+		log.Printf("Domain: %v %v %v zts: %v", domain, kind, change, config.redact(entry))
+	}
+}
+
+// policyEntries returns the policy names and the assertions of the policy
+// data, an assertion is described by its policy, effect, role, action and
+// resource
+func policyEntries(data *zts.DomainSignedPolicyData) (map[string]bool, map[string]bool) {
+	policies := make(map[string]bool)
+	assertions := make(map[string]bool)
+	if data.SignedPolicyData.PolicyData == nil {
+		return policies, assertions
+	}
+	for _, policy := range data.SignedPolicyData.PolicyData.Policies {
+		if policy == nil {
+			continue
+		}
+		policies[string(policy.Name)] = true
+		for _, assertion := range policy.Assertions {
+			if assertion == nil {
+				continue
+			}
+			effect := zts.ALLOW
+			if assertion.Effect != nil {
+				effect = *assertion.Effect
+			}
+			assertions[fmt.Sprintf("%v: %v %v %v on %v", policy.Name, effect, assertion.Role, assertion.Action, assertion.Resource)] = true
+		}
+	}
+	return policies, assertions
+}
+
+// missingEntries returns the sorted entries of from missing in to
+func missingEntries(from, to map[string]bool) []string {
+	missing := []string{}
+	for entry := range from {
+		if !to[entry] {
+			missing = append(missing, entry)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestCompareStoredToFetched(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	stale, err := signPolicyData("diff", now.Add(-time.Hour), now.Add(time.Hour))
+	require.Nil(t, err)
+	effect := zts.DENY
+	stale.SignedPolicyData.PolicyData.Policies = append(stale.SignedPolicyData.PolicyData.Policies, &zts.Policy{
+		Name: "diff:policy.removed",
+		Assertions: []*zts.Assertion{
+			{Role: "diff:role.reader", Resource: "diff:table", Action: "read", Effect: &effect},
+		},
+	})
+	fetched, err := signPolicyData("diff", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"diff": fetched})
+	defer server.Close()
+	defer removePolicyFiles("diff")
+
+	config := getServerConfiguration(server, "diff")
+	require.Nil(t, WritePolicies(config, stale, "diff", POLICIES_DIR))
+	diff, err := CompareStoredToFetched(config, "diff")
+	a.Nil(err)
+	a.False(diff.Identical)
+	a.Equal(stale.SignedPolicyData.Modified.String(), diff.StoredModified)
+	a.Equal(fetched.SignedPolicyData.Modified.String(), diff.FetchedModified)
+	a.Equal([]string{"diff:policy.removed"}, diff.RemovedPolicies)
+	a.Equal([]string{"diff:policy.removed: DENY diff:role.reader read on diff:table"}, diff.RemovedAssertions)
+	a.Equal(0, len(diff.AddedPolicies))
+	a.Equal(0, len(diff.AddedAssertions))
+	stored, err := readPolicyFile(config, POLICIES_DIR+"/diff.pol")
+	a.Nil(err)
+	a.Equal(stale.SignedPolicyData.Modified.String(), stored.SignedPolicyData.Modified.String(), "The stored file is not written")
+
+	require.Nil(t, WritePolicies(config, fetched, "diff", POLICIES_DIR))
+	diff, err = CompareStoredToFetched(config, "diff")
+	a.Nil(err)
+	a.True(diff.Identical)
+	a.Equal(0, len(diff.RemovedPolicies))
+
+	_, err = CompareStoredToFetched(config, "unknown")
+	a.NotNil(err)
+}
+
+func TestCompareStoredToFetchedRedactor(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	stale, err := signPolicyData("redact", now.Add(-time.Hour), now.Add(time.Hour))
+	require.Nil(t, err)
+	stale.SignedPolicyData.PolicyData.Policies[0].Assertions = append(stale.SignedPolicyData.PolicyData.Policies[0].Assertions,
+		&zts.Assertion{Role: "redact:role.payroll", Resource: "redact:salary.jane-doe", Action: "read"})
+	fetched, err := signPolicyData("redact", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"redact": fetched})
+	defer server.Close()
+	defer removePolicyFiles("redact")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := getServerConfiguration(server, "redact")
+	require.Nil(t, WritePolicies(config, stale, "redact", POLICIES_DIR))
+	_, err = CompareStoredToFetched(config, "redact")
+	a.Nil(err)
+	a.True(strings.Contains(logs.String(), "Domain: redact assertion removed from zts: redact:policy.admin: ALLOW redact:role.payroll read on redact:salary.jane-doe"))
+
+	logs.Reset()
+	config.PolicyRedactor = func(content string) string {
+		return strings.Replace(content, "jane-doe", "***", -1)
+	}
+	diff, err := CompareStoredToFetched(config, "redact")
+	a.Nil(err)
+	a.True(strings.Contains(logs.String(), "Domain: redact assertion removed from zts: redact:policy.admin: ALLOW redact:role.payroll read on redact:salary.***"))
+	a.False(strings.Contains(logs.String(), "jane-doe"), "The sensitive resource name is masked in the logs")
+	a.Equal([]string{"redact:policy.admin: ALLOW redact:role.payroll read on redact:salary.jane-doe"}, diff.RemovedAssertions, "The returned diff is not redacted")
+}
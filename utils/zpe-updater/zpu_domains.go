@@ -0,0 +1,169 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// DomainProvider is a source of domains whose policies are updated
+type DomainProvider interface {
+	Domains(ctx context.Context) ([]string, error)
+}
+
+// InlineDomainProvider provides the domains of a comma separated list
+type InlineDomainProvider struct {
+	List string
+}
+
+func (provider *InlineDomainProvider) Domains(ctx context.Context) ([]string, error) {
+	if provider.List == "" {
+		return nil, nil
+	}
+	return strings.Split(provider.List, ","), nil
+}
+
+// FileDomainProvider provides the domains of a file separated by commas or
+// white space
+type FileDomainProvider struct {
+	Path string
+}
+
+func (provider *FileDomainProvider) Domains(ctx context.Context) ([]string, error) {
+	data, err := ioutil.ReadFile(provider.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the domain list file: %v, Error:%v", provider.Path, err)
+	}
+	return splitDomains(string(data)), nil
+}
+
+// ReaderDomainProvider provides the domains read from the reader, separated
+// by commas or white space. The reader is consumed by the first call and
+// every later call returns the domains, or the error, of that call.
+type ReaderDomainProvider struct {
+	Reader io.Reader
+
+	mutex   sync.Mutex
+	read    bool
+	domains []string
+	err     error
+}
+
+func (provider *ReaderDomainProvider) Domains(ctx context.Context) ([]string, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if !provider.read {
+		provider.read = true
+		data, err := ioutil.ReadAll(provider.Reader)
+		if err != nil {
+			provider.err = fmt.Errorf("Failed to read the domain list, Error:%v", err)
+		} else {
+			provider.domains = splitDomains(string(data))
+		}
+	}
+	if provider.err != nil {
+		return nil, provider.err
+	}
+	return append([]string(nil), provider.domains...), nil
+}
+
+func splitDomains(data string) []string {
+	return strings.FieldsFunc(data, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// domainProviders returns the providers of a run: DomainList, DomainListFile
+// and then the configured DomainProviders
+func domainProviders(config *ZpuConfiguration) []DomainProvider {
+	providers := []DomainProvider{}
+	if config.DomainList != "" {
+		providers = append(providers, &InlineDomainProvider{List: config.DomainList})
+	}
+	if config.DomainListFile != "" {
+		providers = append(providers, &FileDomainProvider{Path: config.DomainListFile})
+	}
+	return append(providers, config.DomainProviders...)
+}
+
+// ResolveDomainList returns the domains that PolicyUpdater processes, in
+// order: the domains of DomainList, DomainListFile and the DomainProviders,
+// trimmed of white space, without empty entries and duplicates, filtered by
+// the DomainAllowlist and DomainDenylist
+func ResolveDomainList(config *ZpuConfiguration) ([]string, error) {
+	ctx := context.Background()
+	domains := []string{}
+	for _, provider := range domainProviders(config) {
+		provided, err := provider.Domains(ctx)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, provided...)
+	}
+	return filterDomains(config, uniqueDomains(domains))
+}
+
+// filterDomains keeps the domains of the DomainAllowlist, when it is set,
+// and drops the domains of the DomainDenylist. The FilterPrecedence decides
+// a domain in both lists, the denylist wins by default.
+func filterDomains(config *ZpuConfiguration, domains []string) ([]string, error) {
+	if len(config.DomainAllowlist) == 0 && len(config.DomainDenylist) == 0 {
+		return domains, nil
+	}
+	var allowWins bool
+	switch config.FilterPrecedence {
+	case "", FILTER_PRECEDENCE_DENY:
+		allowWins = false
+	case FILTER_PRECEDENCE_ALLOW:
+		allowWins = true
+	default:
+		return nil, fmt.Errorf("Unknown filter precedence: %v", config.FilterPrecedence)
+	}
+	allowed := make(map[string]bool)
+	for _, domain := range config.DomainAllowlist {
+		allowed[strings.TrimSpace(domain)] = true
+	}
+	denied := make(map[string]bool)
+	for _, domain := range config.DomainDenylist {
+		denied[strings.TrimSpace(domain)] = true
+	}
+	filtered := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if allowed[domain] && denied[domain] {
+			if !allowWins {
+				log.Printf("Dropping domain: %v, it is in both the allowlist and the denylist and the denylist takes precedence", domain)
+				continue
+			}
+			log.Printf("Keeping domain: %v, it is in both the allowlist and the denylist and the allowlist takes precedence", domain)
+			filtered = append(filtered, domain)
+			continue
+		}
+		if denied[domain] || (len(allowed) > 0 && !allowed[domain]) {
+			continue
+		}
+		filtered = append(filtered, domain)
+	}
+	return filtered, nil
+}
+
+func uniqueDomains(domains []string) []string {
+	seen := make(map[string]bool)
+	unique := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.TrimSpace(domain)
+		if domain == "" || seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		unique = append(unique, domain)
+	}
+	return unique
+}
@@ -0,0 +1,186 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+const DOMAIN_LIST_FILE = "/tmp/zpu_domains"
+
+func TestResolveDomainList(t *testing.T) {
+	a := assert.New(t)
+	defer os.Remove(DOMAIN_LIST_FILE)
+	require.Nil(t, ioutil.WriteFile(DOMAIN_LIST_FILE, []byte("file1\nfile2, inline1\n\n"), 0644))
+
+	config := &ZpuConfiguration{DomainList: "inline1,inline2", DomainListFile: DOMAIN_LIST_FILE}
+	domains, err := ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"inline1", "inline2", "file1", "file2"}, domains)
+
+	config.DomainList = ""
+	domains, err = ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"file1", "file2", "inline1"}, domains)
+
+	config.DomainListFile = "/tmp/zpu_missing_domains"
+	_, err = ResolveDomainList(config)
+	a.NotNil(err)
+}
+
+func TestResolveDomainListTrimsEntries(t *testing.T) {
+	a := assert.New(t)
+	config := &ZpuConfiguration{DomainList: " inline1 ,, inline2,\tinline3\n, ,inline1"}
+	config.DomainProviders = []DomainProvider{&staticDomainProvider{domains: []string{" provided1", "", "inline2 "}}}
+	domains, err := ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"inline1", "inline2", "inline3", "provided1"}, domains)
+
+	config = &ZpuConfiguration{DomainList: " , ", Zms: "zms_url", Zts: "zts_url"}
+	a.NotNil(PolicyUpdater(config), "A list of blank entries has no domains")
+}
+
+func TestPolicyUpdaterDomainListFileOnly(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("listfile", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"listfile": data})
+	defer server.Close()
+	defer removePolicyFiles("listfile")
+	defer os.Remove(DOMAIN_LIST_FILE)
+
+	config := getServerConfiguration(server, "")
+	config.DomainListFile = DOMAIN_LIST_FILE
+	require.Nil(t, ioutil.WriteFile(DOMAIN_LIST_FILE, []byte("listfile\n"), 0644))
+	err = PolicyUpdater(config)
+	a.Nil(err)
+	a.Equal([]string{"listfile"}, server.RequestedDomains())
+
+	//all sources empty
+	require.Nil(t, ioutil.WriteFile(DOMAIN_LIST_FILE, []byte("\n"), 0644))
+	err = PolicyUpdater(config)
+	a.NotNil(err)
+}
+
+func TestResolveDomainListMatchesUpdatePolicies(t *testing.T) {
+	a := assert.New(t)
+	defer os.Remove(DOMAIN_LIST_FILE)
+	require.Nil(t, ioutil.WriteFile(DOMAIN_LIST_FILE, []byte("resolve3 resolve1\nresolve4,resolve2\n"), 0644))
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{})
+	defer server.Close()
+
+	config := getServerConfiguration(server, "resolve2,resolve1,resolve2")
+	config.DomainListFile = DOMAIN_LIST_FILE
+	domains, err := ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"resolve2", "resolve1", "resolve3", "resolve4"}, domains)
+
+	UpdatePolicies(config)
+	a.Equal(domains, server.RequestedDomains(), "The resolved list is the list processed by a run")
+}
+
+type staticDomainProvider struct {
+	domains []string
+	calls   int
+}
+
+func (provider *staticDomainProvider) Domains(ctx context.Context) ([]string, error) {
+	provider.calls++
+	return provider.domains, nil
+}
+
+type failingDomainProvider struct{}
+
+func (provider *failingDomainProvider) Domains(ctx context.Context) ([]string, error) {
+	return nil, errors.New("domain service unavailable")
+}
+
+func TestDomainProviders(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("provided1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"provided1": data})
+	defer server.Close()
+	defer removePolicyFiles("provided1")
+
+	custom := &staticDomainProvider{domains: []string{"provided1", "provided2"}}
+	config := getServerConfiguration(server, "")
+	config.DomainProviders = []DomainProvider{
+		custom,
+		&ReaderDomainProvider{Reader: strings.NewReader("provided2\nprovided3")},
+	}
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal(1, custom.calls)
+	a.Equal([]string{"provided1", "provided2", "provided3"}, server.RequestedDomains())
+	a.Equal([]string{"provided1"}, result.UpdatedDomains)
+
+	config.DomainProviders = []DomainProvider{custom, &failingDomainProvider{}}
+	_, err = ResolveDomainList(config)
+	a.NotNil(err)
+}
+
+func TestReaderDomainProviderReuse(t *testing.T) {
+	a := assert.New(t)
+	config := &ZpuConfiguration{
+		DomainProviders: []DomainProvider{&ReaderDomainProvider{Reader: strings.NewReader("reader1,reader2")}},
+	}
+	for i := 0; i < 2; i++ {
+		domains, err := ResolveDomainList(config)
+		a.Nil(err)
+		a.Equal([]string{"reader1", "reader2"}, domains, "Every run resolves the domains read by the first one")
+	}
+
+	provider := &ReaderDomainProvider{Reader: iotest.ErrReader(errors.New("read failed"))}
+	for i := 0; i < 2; i++ {
+		_, err := provider.Domains(context.Background())
+		a.NotNil(err)
+		a.True(strings.Contains(err.Error(), "read failed"))
+	}
+}
+
+func TestResolveDomainListFilterPrecedence(t *testing.T) {
+	a := assert.New(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := &ZpuConfiguration{
+		DomainList:      "sports,weather,news,finance",
+		DomainAllowlist: []string{"sports", "weather", "news"},
+		DomainDenylist:  []string{"news", "finance"},
+	}
+	domains, err := ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"sports", "weather"}, domains, "The denylist wins by default")
+	a.True(strings.Contains(logs.String(), "Dropping domain: news"))
+
+	config.FilterPrecedence = FILTER_PRECEDENCE_ALLOW
+	domains, err = ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"sports", "weather", "news"}, domains, "The allowlist wins when configured")
+
+	config.DomainAllowlist = nil
+	domains, err = ResolveDomainList(config)
+	a.Nil(err)
+	a.Equal([]string{"sports", "weather"}, domains, "A denylist alone drops its domains")
+
+	config.FilterPrecedence = "random"
+	_, err = ResolveDomainList(config)
+	a.NotNil(err)
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// etagFile holds the etag returned by zts with the stored policies of the
+// policy file, see StoreServerEtag
+func etagFile(policyFile string) string {
+	return policyFile + ".etag"
+}
+
+// storedEtag is the content of the etag file. The etag is bound to the
+// signature of the policies it was returned with.
+type storedEtag struct {
+	Etag      string `json:"etag"`
+	Signature string `json:"signature"`
+}
+
+// updateServerEtag stores the etag returned by zts with the policy data once
+// the policy file is written, an empty etag removes the etag file. The file
+// is written to the temporary policy directory and moved into place, so it
+// holds either the previous etag or the new one. A crash before the move
+// leaves the previous etag, never replayed for the new policies since their
+// signature differs.
+func updateServerEtag(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain, policyFile, etag string) error {
+	sidecar := etagFile(policyFile)
+	if etag == "" {
+		if util.Exists(sidecar) {
+			return os.Remove(sidecar)
+		}
+		return nil
+	}
+	bytes, err := json.Marshal(&storedEtag{Etag: etag, Signature: data.Signature})
+	if err != nil {
+		return err
+	}
+	err = verifyTmpDirSetup(config.tmpPolicyDir())
+	if err != nil {
+		return err
+	}
+	tempFile := fmt.Sprintf("%s/%s.etag.tmp", config.tmpPolicyDir(), domain)
+	err = ioutil.WriteFile(tempFile, bytes, 0644)
+	if err != nil {
+		return err
+	}
+	err = commitPolicyFile(config, tempFile, sidecar)
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("Unable to store etag of domain: %v, Error:%v", domain, err)
+	}
+	return nil
+}
+
+// storedServerEtag returns the etag stored with the policy data of the
+// policy file, "" when there is none or it was stored with other policies
+func storedServerEtag(policyFile string, data *zts.DomainSignedPolicyData) string {
+	bytes, err := ioutil.ReadFile(etagFile(policyFile))
+	if err != nil {
+		return ""
+	}
+	var stored storedEtag
+	err = json.Unmarshal(bytes, &stored)
+	if err != nil {
+		log.Printf("Ignoring unreadable etag file of policy file: %v, Error:%v", policyFile, err)
+		return ""
+	}
+	if stored.Signature == "" || stored.Signature != data.Signature {
+		return ""
+	}
+	return stored.Etag
+}
+
+// etagMissFile counts the consecutive conditional fetches of the domain that
+// returned the stored policies in full
+func etagMissFile(config *ZpuConfiguration, domain string) string {
+	return fmt.Sprintf("%s/%s.etagmiss", config.tmpPolicyDir(), domain)
+}
+
+// trackIneffectiveEtag warns once a conditional fetch has returned the very
+// policies the etag was built from EtagMismatchWarnAfter times in a row, zts
+// no longer recognizes the etag and every run downloads the full policies
+func trackIneffectiveEtag(config *ZpuConfiguration, domain, etag string, data *zts.DomainSignedPolicyData) {
+	if etag == "" {
+		return
+	}
+	missFile := etagMissFile(config, domain)
+	if data == nil || "\""+data.SignedPolicyData.Modified.String()+"\"" != etag {
+		os.Remove(missFile)
+		return
+	}
+	misses := 0
+	if bytes, err := ioutil.ReadFile(missFile); err == nil {
+		misses, _ = strconv.Atoi(strings.TrimSpace(string(bytes)))
+	}
+	misses++
+	err := verifyTmpDirSetup(config.tmpPolicyDir())
+	if err == nil {
+		err = ioutil.WriteFile(missFile, []byte(strconv.Itoa(misses)), 0644)
+	}
+	if err != nil {
+		log.Printf("Unable to record ineffective etag of domain: %v, Error:%v", domain, err)
+	}
+	threshold := config.EtagMismatchWarnAfter
+	if threshold <= 0 {
+		threshold = DEFAULT_ETAG_MISMATCH_WARN_AFTER
+	}
+	if misses >= threshold {
+		log.Printf("Warning: the etag %v of domain: %v was not matched by zts for %v consecutive runs, the policies are fetched in full every run, consider storing the etag returned by zts", etag, domain, misses)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestIneffectiveEtagWarning(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("etagmiss", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	//the server ignores If-None-Match and always returns the policies
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}))
+	defer server.Close()
+	defer removePolicyFiles("etagmiss")
+	removePolicyFiles("etagmiss")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := getSigningConfiguration()
+	config.Zts = server.URL
+	config.Zms = server.URL
+	config.DomainList = "etagmiss"
+	config.PolicyFileDir = POLICIES_DIR
+	config.MetricsDir = ""
+	config.EtagMismatchWarnAfter = 2
+	missFile := etagMissFile(config, "etagmiss")
+	defer os.Remove(missFile)
+	os.Remove(missFile)
+
+	for run := 1; run <= 3; run++ {
+		_, err = UpdatePolicies(config)
+		a.Nil(err)
+		warned := strings.Contains(logs.String(), "was not matched by zts for 2 consecutive runs")
+		a.Equal(run == 3, warned, "The warning is logged after two ineffective conditional fetches")
+	}
+
+	//a matching etag resets the count
+	trackIneffectiveEtag(config, "etagmiss", "\""+data.SignedPolicyData.Modified.String()+"\"", nil)
+	a.Equal(util.Exists(missFile), false)
+}
+
+func TestStoreServerEtag(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data1, err := signPolicyData("etagstore", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	data2, err := signPolicyData("etagstore", now.Add(time.Second), now.Add(time.Hour))
+	require.Nil(t, err)
+	//the server etags are opaque revisions, not the modified time
+	var mutex sync.Mutex
+	served, revision, received := data1, "\"rev-1\"", []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == revision {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", revision)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(served)
+	}))
+	defer server.Close()
+	config := getSigningConfiguration()
+	config.Zts = server.URL
+	config.Zms = server.URL
+	config.DomainList = "etagstore"
+	config.PolicyFileDir = POLICIES_DIR
+	config.MetricsDir = ""
+	config.StoreServerEtag = true
+	policyFile := config.policyFile(POLICIES_DIR, "etagstore")
+	defer os.Remove(etagFile(policyFile))
+	defer removePolicyFiles("etagstore")
+	removePolicyFiles("etagstore")
+	os.Remove(etagFile(policyFile))
+
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"etagstore"}, result.UpdatedDomains)
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"etagstore"}, result.NotModifiedDomains, "The stored server etag is matched")
+	a.Equal([]string{"", "\"rev-1\""}, received)
+
+	//crash after the policy file is moved into place, before the etag file
+	//is: the etag file and a partial temporary etag file hold the old etag
+	require.Nil(t, WritePolicies(config, data2, "etagstore", POLICIES_DIR))
+	require.Nil(t, ioutil.WriteFile(config.tmpPolicyDir()+"/etagstore.etag.tmp", []byte(`{"etag":"\"rev-2`), 0644))
+	etag, err := GetEtagForExistingPolicy(config, zmsClientForTest(), "etagstore", POLICIES_DIR)
+	a.Nil(err)
+	a.Equal("\""+data2.SignedPolicyData.Modified.String()+"\"", etag, "The old etag is not replayed for the new policies")
+
+	//crash before the policy file is moved into place: the old policies
+	//keep their etag
+	require.Nil(t, WritePolicies(config, data1, "etagstore", POLICIES_DIR))
+	etag, err = GetEtagForExistingPolicy(config, zmsClientForTest(), "etagstore", POLICIES_DIR)
+	a.Nil(err)
+	a.Equal("\"rev-1\"", etag)
+
+	mutex.Lock()
+	served, revision = data2, "\"rev-2\""
+	mutex.Unlock()
+	config.BatchFsync = true
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"etagstore"}, result.UpdatedDomains)
+	etag, err = GetEtagForExistingPolicy(config, zmsClientForTest(), "etagstore", POLICIES_DIR)
+	a.Nil(err)
+	a.Equal("\"rev-2\"", etag, "The batch stores the etag with the policies")
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"time"
+)
+
+type ZpuEventType int
+
+const (
+	RunStarted ZpuEventType = iota
+	DomainFetched
+	DomainNotModified
+	DomainFailed
+	RunFinished
+	// DomainExpiring reports a failed domain whose stored policies expire
+	// within the ExpiryAlertThreshold
+	DomainExpiring
+)
+
+var zpuEventTypeNames = []string{"RunStarted", "DomainFetched", "DomainNotModified", "DomainFailed", "RunFinished", "DomainExpiring"}
+
+func (eventType ZpuEventType) String() string {
+	if int(eventType) < 0 || int(eventType) >= len(zpuEventTypeNames) {
+		return "Unknown"
+	}
+	return zpuEventTypeNames[eventType]
+}
+
+// ZpuEvent is sent on the configured EventChannel as a run progresses.
+// Domain and Err are only set for the domain events.
+type ZpuEvent struct {
+	Type   ZpuEventType
+	Time   time.Time
+	Domain string
+	Err    error
+}
+
+// emit sends the event without blocking, events are dropped and counted
+// when the channel is full
+func (run *runState) emit(config *ZpuConfiguration, eventType ZpuEventType, domain string, err error) {
+	if config.EventChannel == nil {
+		return
+	}
+	event := ZpuEvent{Type: eventType, Time: config.GetClock().Now(), Domain: domain, Err: err}
+	select {
+	case config.EventChannel <- event:
+	default:
+		run.droppedEvents++
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestUpdatePoliciesEventChannel(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("events1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"events1": data})
+	defer server.Close()
+	defer removePolicyFiles("events1")
+
+	events := make(chan ZpuEvent, 10)
+	config := getServerConfiguration(server, "events1,events2")
+	config.EventChannel = events
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal(0, result.DroppedEvents)
+	result, err = UpdatePolicies(config)
+	a.NotNil(err)
+	close(events)
+
+	expected := []struct {
+		eventType ZpuEventType
+		domain    string
+	}{
+		{RunStarted, ""},
+		{DomainFetched, "events1"},
+		{DomainFailed, "events2"},
+		{RunFinished, ""},
+		{RunStarted, ""},
+		{DomainNotModified, "events1"},
+		{DomainFailed, "events2"},
+		{RunFinished, ""},
+	}
+	received := []ZpuEvent{}
+	for event := range events {
+		received = append(received, event)
+	}
+	require.Equal(t, len(expected), len(received))
+	for i, event := range received {
+		a.Equal(expected[i].eventType.String(), event.Type.String())
+		a.Equal(expected[i].domain, event.Domain)
+		a.Equal(event.Type == DomainFailed, event.Err != nil)
+		a.False(event.Time.IsZero())
+	}
+}
+
+func TestUpdatePoliciesEventChannelBatchFsync(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	policies := map[string]*zts.DomainSignedPolicyData{}
+	for _, domain := range []string{"events3", "events4"} {
+		data, err := signPolicyData(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		policies[domain] = data
+	}
+	server := startPolicyServer(policies)
+	defer server.Close()
+	defer removePolicyFiles("events3", "events4")
+	removePolicyFiles("events3", "events4")
+
+	//the staged file of events4 cannot be synced, its commit fails
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	syncFile = func(file *os.File) error {
+		if strings.HasSuffix(file.Name(), "/events4.tmp") {
+			return syscall.EIO
+		}
+		return file.Sync()
+	}
+	events := make(chan ZpuEvent, 10)
+	config := getServerConfiguration(server, "events3,events4")
+	config.EventChannel = events
+	config.BatchFsync = true
+	_, err := UpdatePolicies(config)
+	a.NotNil(err)
+	close(events)
+
+	received := []string{}
+	for event := range events {
+		received = append(received, event.Type.String()+" "+event.Domain)
+	}
+	a.Equal([]string{"RunStarted ", "DomainFetched events3", "DomainFailed events4", "RunFinished "}, received, "A domain gets a single event once the batch is committed")
+}
+
+func TestUpdatePoliciesEventChannelFull(t *testing.T) {
+	a := assert.New(t)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{})
+	defer server.Close()
+
+	events := make(chan ZpuEvent, 1)
+	config := getServerConfiguration(server, "events1,events2")
+	config.EventChannel = events
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal(3, result.DroppedEvents, "Only the first event fits in the channel")
+	event := <-events
+	a.Equal(RunStarted, event.Type)
+}
+
+func TestUpdatePoliciesExpiryAlert(t *testing.T) {
+	a := assert.New(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	now := time.Now()
+	expiring, err := signPolicyData("expiring1", now, now.Add(30*time.Minute))
+	require.Nil(t, err)
+	valid, err := signPolicyData("expiring2", now, now.Add(3*time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"expiring1": expiring, "expiring2": valid})
+	defer server.Close()
+	defer removePolicyFiles("expiring1", "expiring2")
+
+	events := make(chan ZpuEvent, 20)
+	config := getServerConfiguration(server, "expiring1,expiring2")
+	config.EventChannel = events
+	config.ExpiryAlertThreshold = time.Hour
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "Alert:"), "Refreshed domains are not alerted")
+
+	//zts stops serving the domains
+	server.SetPolicies("expiring1", nil)
+	server.SetPolicies("expiring2", nil)
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal([]string{"expiring1", "expiring2"}, result.FailedDomains)
+	close(events)
+
+	alerts := []ZpuEvent{}
+	for event := range events {
+		if event.Type == DomainExpiring {
+			alerts = append(alerts, event)
+		}
+	}
+	require.Equal(t, 1, len(alerts), "Only the domain expiring within the threshold is alerted")
+	a.Equal("expiring1", alerts[0].Domain)
+	a.IsType(&ExpiringPolicyError{}, alerts[0].Err)
+	a.True(strings.Contains(logs.String(), "Alert: The stored policies of domain: expiring1 expire on"))
+}
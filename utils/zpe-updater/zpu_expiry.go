@@ -0,0 +1,48 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+// ExpiringPolicyError is sent with a DomainExpiring event when the stored
+// policies of a domain that could not be refreshed expire within the
+// ExpiryAlertThreshold.
+type ExpiringPolicyError struct {
+	Domain    string
+	Expires   rdl.Timestamp
+	Threshold time.Duration
+}
+
+func (e *ExpiringPolicyError) Error() string {
+	return fmt.Sprintf("The stored policies of domain: %v expire on %v, within %v, and could not be refreshed", e.Domain, e.Expires, e.Threshold)
+}
+
+// alertExpiringPolicies alerts on the failed domains whose stored policies
+// expire within the ExpiryAlertThreshold, before enforcement stops
+func alertExpiringPolicies(config *ZpuConfiguration, run *runState, failedDomains []string, policyFileDir string) {
+	threshold := config.ExpiryAlertThreshold
+	if threshold <= 0 {
+		return
+	}
+	now := config.GetClock().Now()
+	for _, domain := range failedDomains {
+		data, err := readPolicyFile(config, config.policyFile(policyFileDir, domain))
+		if err != nil || data.SignedPolicyData == nil {
+			continue
+		}
+		expires := data.SignedPolicyData.Expires
+		if expires.Time.Sub(now) > threshold {
+			continue
+		}
+		err = &ExpiringPolicyError{Domain: domain, Expires: expires, Threshold: threshold}
+		log.Printf("Alert: %v", err)
+		run.emit(config, DomainExpiring, domain, err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// DomainTimeBudgetError is returned when fetching the policies of a domain
+// takes longer than the PerDomainTimeBudget, whatever retries are left.
+type DomainTimeBudgetError struct {
+	Domain   string
+	Budget   time.Duration
+	Attempts int
+	Err      error
+}
+
+func (e *DomainTimeBudgetError) Error() string {
+	return fmt.Sprintf("Time budget of %v for domain: %v exceeded after %v attempts, Error:%v", e.Budget, e.Domain, e.Attempts, e.Err)
+}
+
+// fetchSignedPolicyData gets the signed policy data of the domain, retrying
+// failed requests up to RetryCount times after RetryBackoff. With a
+// PerDomainTimeBudget every attempt and backoff is limited to the time left
+// in the budget. The etag returned by zts with the policy data is returned
+// with it.
+func fetchSignedPolicyData(config *ZpuConfiguration, ztsClient zts.ZTSClient, domain, etag string) (*zts.DomainSignedPolicyData, string, error) {
+	clock := config.GetClock()
+	start := clock.Now()
+	budget := config.PerDomainTimeBudget
+	var err error
+	attempts := 0
+	for attempts <= config.RetryCount {
+		if attempts > 0 && config.RetryBackoff > 0 {
+			backoff := config.RetryBackoff
+			if budget > 0 && budget-clock.Since(start) < backoff {
+				backoff = budget - clock.Since(start)
+			}
+			if backoff > 0 {
+				clock.Sleep(backoff)
+			}
+		}
+		if budget > 0 {
+			remaining := budget - clock.Since(start)
+			if remaining <= 0 {
+				return nil, "", &DomainTimeBudgetError{Domain: domain, Budget: budget, Attempts: attempts, Err: err}
+			}
+			if ztsClient.Timeout == 0 || remaining < ztsClient.Timeout {
+				ztsClient.Timeout = remaining
+			}
+		}
+		attempts++
+		var data *zts.DomainSignedPolicyData
+		var serverEtag string
+		data, serverEtag, err = ztsClient.GetDomainSignedPolicyData(zts.DomainName(domain), etag)
+		if err == nil {
+			return data, serverEtag, nil
+		}
+		if !retryable(err) {
+			break
+		}
+		if attempts <= config.RetryCount {
+			log.Printf("Attempt %v to get policies for domain: %v failed, Error:%v", attempts, domain, err)
+		}
+	}
+	if budget > 0 && clock.Since(start) >= budget {
+		return nil, "", &DomainTimeBudgetError{Domain: domain, Budget: budget, Attempts: attempts, Err: err}
+	}
+	return nil, "", fmt.Errorf("Failed to get domain signed policy data for domain: %v, Error:%w", domain, err)
+}
+
+// retryable reports whether a failed request may succeed when retried, the
+// client errors returned by zts other than throttling are final
+func retryable(err error) bool {
+	if resourceErr, ok := err.(rdl.ResourceError); ok {
+		return resourceErr.Code >= 500 || resourceErr.Code == 429
+	}
+	var contentErr *UnexpectedContentTypeError
+	var fieldErr *UnknownFieldError
+	var depthErr *JSONDepthError
+	var insecureErr *InsecureURLError
+	return !errors.As(err, &contentErr) && !errors.As(err, &fieldErr) && !errors.As(err, &depthErr) && !errors.As(err, &insecureErr)
+}
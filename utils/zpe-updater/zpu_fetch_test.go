@@ -0,0 +1,120 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// startFailingServer returns a server answering every request with the
+// status after the delay, counting the requests
+func startFailingServer(status int, delay time.Duration, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		time.Sleep(delay)
+		w.WriteHeader(status)
+	}))
+}
+
+func TestFetchSignedPolicyDataRetries(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := startFailingServer(http.StatusServiceUnavailable, 0, &requests)
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 2}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "retry1", "")
+	a.NotNil(err)
+	a.Equal(int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestFetchSignedPolicyDataNoRetryOnNotFound(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := startFailingServer(http.StatusNotFound, 0, &requests)
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 2}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "retry2", "")
+	a.NotNil(err)
+	a.Equal(int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestPerDomainTimeBudget(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := startFailingServer(http.StatusServiceUnavailable, 100*time.Millisecond, &requests)
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 20, PerDomainTimeBudget: 250 * time.Millisecond}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	start := time.Now()
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "budget1", "")
+	a.IsType(&DomainTimeBudgetError{}, err)
+	a.True(time.Since(start) < time.Second, "The budget stops the retries")
+	a.True(atomic.LoadInt32(&requests) < 21)
+}
+
+func TestFetchSignedPolicyDataRetryBackoff(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := startFailingServer(http.StatusServiceUnavailable, 0, &requests)
+	defer server.Close()
+
+	clock := newFakeClock(time.Now())
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 2, RetryBackoff: time.Minute, Clock: clock}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	start := clock.Now()
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "backoff1", "")
+	a.NotNil(err)
+	a.Equal(int32(3), atomic.LoadInt32(&requests))
+	a.Equal(2*time.Minute, clock.Since(start), "The attempts are RetryBackoff apart")
+
+	//the backoff is cut to the budget left, which then stops the retries
+	requests = 0
+	config.PerDomainTimeBudget = 90 * time.Second
+	start = clock.Now()
+	_, _, err = fetchSignedPolicyData(config, ztsClient, "backoff1", "")
+	budgetErr, ok := err.(*DomainTimeBudgetError)
+	a.True(ok)
+	a.Equal(2, budgetErr.Attempts)
+	a.Equal(int32(2), atomic.LoadInt32(&requests))
+	a.Equal(90*time.Second, clock.Since(start))
+}
+
+func TestDomainTimeBudgetErrorAttempts(t *testing.T) {
+	a := assert.New(t)
+	var requests int32
+	server := startFailingServer(http.StatusNotFound, 0, &requests)
+	defer server.Close()
+
+	//the budget runs out during the first attempt, which is not retried
+	clock := newFakeClock(time.Now())
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, RetryCount: 5, PerDomainTimeBudget: time.Second, Clock: clock}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), &slowTransport{clock: clock, delay: 2 * time.Second})
+	_, _, err := fetchSignedPolicyData(config, ztsClient, "budget2", "")
+	budgetErr, ok := err.(*DomainTimeBudgetError)
+	a.True(ok)
+	a.Equal(1, budgetErr.Attempts, "The attempts that were made are reported")
+}
+
+// slowTransport advances the clock by the delay on every request
+type slowTransport struct {
+	clock *fakeClock
+	delay time.Duration
+}
+
+func (transport *slowTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.clock.Advance(transport.delay)
+	return http.DefaultTransport.RoundTrip(req)
+}
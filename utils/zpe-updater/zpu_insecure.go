@@ -0,0 +1,54 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// InsecureURLError is returned for requests to zts or zms over plaintext
+// http when AllowInsecureHTTP is not set
+type InsecureURLError struct {
+	URL string
+}
+
+func (e *InsecureURLError) Error() string {
+	return fmt.Sprintf("Refusing plaintext http request to: %v, use https or set AllowInsecureHTTP for local development", e.URL)
+}
+
+// insecureTransport refuses http requests unless insecure http is allowed.
+// When allowed, an https request to a server answering in plaintext, such
+// as a local zts mock, is retried over http.
+type insecureTransport struct {
+	base  http.RoundTripper
+	allow bool
+}
+
+func (transport *insecureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && !transport.allow {
+		return nil, &InsecureURLError{URL: req.URL.String()}
+	}
+	resp, err := transport.base.RoundTrip(req)
+	var recordErr tls.RecordHeaderError
+	if err == nil || !transport.allow || req.URL.Scheme != "https" || !errors.As(err, &recordErr) {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, err
+	}
+	insecureReq := req.Clone(req.Context())
+	insecureReq.URL.Scheme = "http"
+	if req.GetBody != nil {
+		insecureReq.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Warning: tls handshake with %v failed, retrying over plaintext http because AllowInsecureHTTP is set", req.URL.Host)
+	return transport.base.RoundTrip(insecureReq)
+}
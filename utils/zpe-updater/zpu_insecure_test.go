@@ -0,0 +1,76 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestAllowInsecureHTTP(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("insecure", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"insecure": data})
+	defer server.Close()
+	defer removePolicyFiles("insecure")
+	removePolicyFiles("insecure")
+
+	config := getServerConfiguration(server, "insecure")
+	config.AllowInsecureHTTP = false
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal([]string{"insecure"}, result.FailedDomains)
+	a.Empty(server.RequestedDomains(), "Plaintext requests are refused before they are sent")
+	var insecureErr *InsecureURLError
+	a.True(errors.As(config.LastError("insecure"), &insecureErr))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config.AllowInsecureHTTP = true
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"insecure"}, result.UpdatedDomains)
+	a.True(strings.Contains(logs.String(), "Warning: AllowInsecureHTTP is set"))
+}
+
+func TestAllowInsecureHTTPFallback(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("fallback", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"fallback": data})
+	defer server.Close()
+	defer removePolicyFiles("fallback")
+	removePolicyFiles("fallback")
+
+	//the plaintext server is configured with https urls
+	config := getServerConfiguration(server, "fallback")
+	config.Zts = strings.Replace(server.URL, "http://", "https://", 1)
+	config.Zms = config.Zts
+	config.AllowInsecureHTTP = false
+	result, err := UpdatePolicies(config)
+	a.NotNil(err, "The tls handshake fails without AllowInsecureHTTP")
+	a.Equal([]string{"fallback"}, result.FailedDomains)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config.AllowInsecureHTTP = true
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"fallback"}, result.UpdatedDomains)
+	a.True(strings.Contains(logs.String(), "retrying over plaintext http"))
+}
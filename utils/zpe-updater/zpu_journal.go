@@ -0,0 +1,87 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+const JOURNAL_FILE_NAME = "zpu.journal"
+
+// The journal records every domain successfully updated during a run as a
+// "<domain> <unix time>" line. It is removed once the run completes, so a
+// journal found at start up belongs to a run that was interrupted.
+func journalFile(config *ZpuConfiguration) string {
+	return fmt.Sprintf("%s/%s", config.tmpPolicyDir(), JOURNAL_FILE_NAME)
+}
+
+// readJournal returns the domains updated by the interrupted run within the
+// configured resume window
+func readJournal(config *ZpuConfiguration) map[string]bool {
+	domains := make(map[string]bool)
+	file := journalFile(config)
+	if !util.Exists(file) {
+		return domains
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("Unable to read journal file: %v, Error:%v", file, err)
+		return domains
+	}
+	window := config.ResumeWindow
+	if window <= 0 {
+		window = DEFAULT_RESUME_WINDOW
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		updated, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		if config.GetClock().Since(time.Unix(updated, 0)) <= window {
+			domains[fields[0]] = true
+		}
+	}
+	return domains
+}
+
+func appendJournal(config *ZpuConfiguration, domain string) {
+	err := verifyTmpDirSetup(config.tmpPolicyDir())
+	if err != nil {
+		log.Printf("Unable to create directory for journal file, Error:%v", err)
+		return
+	}
+	file, err := os.OpenFile(journalFile(config), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		log.Printf("Unable to open journal file, Error:%v", err)
+		return
+	}
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s %d\n", domain, config.GetClock().Now().Unix())
+	if err != nil {
+		log.Printf("Unable to record domain: %v in journal file, Error:%v", domain, err)
+	}
+}
+
+func removeJournal(config *ZpuConfiguration) {
+	file := journalFile(config)
+	if !util.Exists(file) {
+		return
+	}
+	err := os.Remove(file)
+	if err != nil {
+		log.Printf("Unable to remove journal file: %v, Error:%v", file, err)
+	}
+}
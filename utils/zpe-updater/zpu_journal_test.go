@@ -0,0 +1,71 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestPolicyUpdaterResumeLastRun(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	policies := map[string]*zts.DomainSignedPolicyData{}
+	for _, domain := range []string{"resume1", "resume2", "resume3"} {
+		data, err := signPolicyData(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		policies[domain] = data
+	}
+	server := startPolicyServer(policies)
+	defer server.Close()
+	defer removePolicyFiles("resume1", "resume2", "resume3")
+
+	config := getServerConfiguration(server, "resume1,resume2,resume3")
+	config.ResumeLastRun = true
+
+	//the interrupted run updated resume1 recently and resume2 outside the window
+	journal := fmt.Sprintf("resume1 %d\nresume2 %d\n", now.Unix(), now.Add(-2*DEFAULT_RESUME_WINDOW).Unix())
+	err := ioutil.WriteFile(journalFile(config), []byte(journal), 0644)
+	require.Nil(t, err)
+
+	err = PolicyUpdater(config)
+	a.Nil(err)
+	a.Equal([]string{"resume2", "resume3"}, server.RequestedDomains())
+	a.Equal(util.Exists(journalFile(config)), false, "Journal should be removed after a completed run")
+
+	//without the flag every domain is fetched
+	config.ResumeLastRun = false
+	err = ioutil.WriteFile(journalFile(config), []byte(journal), 0644)
+	require.Nil(t, err)
+	server.Reset()
+	err = PolicyUpdater(config)
+	a.Nil(err)
+	a.Equal([]string{"resume1", "resume2", "resume3"}, server.RequestedDomains())
+	removeJournal(config)
+}
+
+func TestReadJournal(t *testing.T) {
+	a := assert.New(t)
+	config := getSigningConfiguration()
+	removeJournal(config)
+	a.Empty(readJournal(config))
+
+	appendJournal(config, "journal1")
+	appendJournal(config, "journal2")
+	a.Equal(map[string]bool{"journal1": true, "journal2": true}, readJournal(config))
+
+	config.ResumeWindow = time.Minute
+	err := ioutil.WriteFile(journalFile(config), []byte(fmt.Sprintf("journal1 %d\ninvalid\n", time.Now().Add(-time.Hour).Unix())), 0644)
+	a.Nil(err)
+	a.Empty(readJournal(config))
+	removeJournal(config)
+	a.Equal(util.Exists(journalFile(config)), false)
+}
@@ -0,0 +1,100 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/libs/go/zmssvctoken"
+)
+
+// publicKeyGetter returns the decoded public key of the zts or zms service
+// with the key id
+type publicKeyGetter func(service, keyId string) (string, error)
+
+// EmptyPublicKeyError is returned when zms returns a public key entry with
+// no key material for the key id.
+type EmptyPublicKeyError struct {
+	Service string
+	KeyId   string
+}
+
+func (e *EmptyPublicKeyError) Error() string {
+	return fmt.Sprintf("Zms returned no key material for the %v public key with id:\"%v\"", e.Service, e.KeyId)
+}
+
+// missingPublicKeyMessage is the validation error of the generated zms client
+// for a public key entry without a key
+const missingPublicKeyMessage = "PublicKeyEntry.key is missing"
+
+// fetchPublicKey gets the public key of the sys.auth zts or zms service
+// from zms, waiting while MaxConcurrentKeyFetches keys are being fetched
+func fetchPublicKey(config *ZpuConfiguration, zmsClient zms.ZMSClient, service, keyId string) (string, error) {
+	name := strings.ToUpper(service[:1]) + service[1:]
+	keyFetches := config.keyFetchSemaphore()
+	keyFetches.acquire()
+	key, err := zmsClient.GetPublicKeyEntry("sys.auth", zms.SimpleName(service), keyId)
+	keyFetches.release()
+	if err != nil {
+		// the generated client rejects an entry without a key as invalid,
+		// with an untyped error
+		if strings.Contains(err.Error(), missingPublicKeyMessage) {
+			return "", &EmptyPublicKeyError{Service: service, KeyId: keyId}
+		}
+		return "", fmt.Errorf("Unable to get the %v public key with id:\"%v\" to verify data", name, keyId)
+	}
+	if key == nil || key.Key == "" {
+		return "", &EmptyPublicKeyError{Service: service, KeyId: keyId}
+	}
+	decodedKey, err := new(zmssvctoken.YBase64).DecodeString(key.Key)
+	if err != nil {
+		return "", fmt.Errorf("Unable to decode the %v public key with id:\"%v\" to verify data", name, keyId)
+	}
+	if len(decodedKey) == 0 {
+		return "", &EmptyPublicKeyError{Service: service, KeyId: keyId}
+	}
+	return string(decodedKey), nil
+}
+
+// publicKeyCache shares the public keys fetched from zms between goroutines,
+// concurrent lookups of the same key wait for a single fetch
+type publicKeyCache struct {
+	config    *ZpuConfiguration
+	zmsClient zms.ZMSClient
+	mutex     sync.Mutex
+	keys      map[string]*cachedPublicKey
+}
+
+type cachedPublicKey struct {
+	ready chan struct{}
+	key   string
+	err   error
+}
+
+func newPublicKeyCache(config *ZpuConfiguration, zmsClient zms.ZMSClient) *publicKeyCache {
+	return &publicKeyCache{config: config, zmsClient: zmsClient, keys: make(map[string]*cachedPublicKey)}
+}
+
+func (cache *publicKeyCache) get(service, keyId string) (string, error) {
+	name := service + "/" + keyId
+	cache.mutex.Lock()
+	cached, ok := cache.keys[name]
+	if !ok {
+		cached = &cachedPublicKey{ready: make(chan struct{})}
+		cache.keys[name] = cached
+	}
+	cache.mutex.Unlock()
+	counters := cache.config.cacheCounters()
+	countLookup(ok, &counters.PublicKeyHits, &counters.PublicKeyMisses)
+	if ok {
+		<-cached.ready
+		return cached.key, cached.err
+	}
+	cached.key, cached.err = fetchPublicKey(cache.config, cache.zmsClient, service, keyId)
+	close(cached.ready)
+	return cached.key, cached.err
+}
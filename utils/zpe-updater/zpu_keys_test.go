@@ -0,0 +1,49 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+)
+
+func TestFetchPublicKeyEmptyKey(t *testing.T) {
+	a := assert.New(t)
+	key := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: "zms.empty", Key: key})
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	data, err := testPolicySigner("0", "zms.empty").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{}
+	err = ValidateSignedPolicies(config, zms.NewClient(formatUrl(server.URL, "zms/v1"), nil), data)
+	a.IsType(&EmptyPublicKeyError{}, err)
+	a.Equal(`Zms returned no key material for the zms public key with id:"zms.empty"`, err.Error())
+
+	//a key with no base64 content decodes to nothing
+	key = "\n"
+	err = ValidateSignedPolicies(config, zms.NewClient(formatUrl(server.URL, "zms/v1"), nil), data)
+	a.IsType(&EmptyPublicKeyError{}, err)
+}
+
+func TestMissingPublicKeyMessage(t *testing.T) {
+	a := assert.New(t)
+	//the generated client reports an entry without a key with this message
+	err := (&zms.PublicKeyEntry{Id: "zms.empty"}).Validate()
+	a.NotNil(err)
+	a.True(strings.Contains(err.Error(), missingPublicKeyMessage), err.Error())
+}
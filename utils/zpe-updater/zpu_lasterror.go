@@ -0,0 +1,41 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"sync"
+)
+
+// domainErrors remembers the error of the last run of each domain across the
+// runs of a configuration
+type domainErrors struct {
+	mutex sync.Mutex
+	errs  map[string]error
+}
+
+func (config *ZpuConfiguration) domainErrors() *domainErrors {
+	config.initSharedState()
+	return config.lastErrors
+}
+
+// set records the outcome of the domain, a nil error clears its last error
+func (state *domainErrors) set(domain string, err error) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if err == nil {
+		delete(state.errs, domain)
+		return
+	}
+	state.errs[domain] = err
+}
+
+// LastError returns the error of the most recent UpdatePolicies run of this
+// configuration that failed the domain, nil when the domain has not failed
+// since its last successful run
+func (config *ZpuConfiguration) LastError(domain string) error {
+	state := config.domainErrors()
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.errs[domain]
+}
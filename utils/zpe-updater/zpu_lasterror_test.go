@@ -0,0 +1,36 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestLastError(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("lasterror", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{})
+	defer server.Close()
+	defer removePolicyFiles("lasterror")
+
+	config := getServerConfiguration(server, "lasterror")
+	a.Nil(config.LastError("lasterror"))
+	_, err = UpdatePolicies(config)
+	a.NotNil(err)
+	a.NotNil(config.LastError("lasterror"), "The failure of the domain is kept")
+	a.Nil(config.LastError("unknown"))
+
+	server.SetPolicies("lasterror", data)
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Nil(config.LastError("lasterror"), "A successful run clears the last error")
+
+}
@@ -0,0 +1,69 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ardielle/ardielle-go/rdl"
+)
+
+// logSampler logs the first threshold domain errors of each category in a
+// run and counts the others for a summary at the end of the run, so a zts
+// outage does not log a line for every domain
+type logSampler struct {
+	threshold  int
+	counts     map[string]int
+	suppressed map[string]int
+	categories []string
+}
+
+func newLogSampler(threshold int) *logSampler {
+	return &logSampler{threshold: threshold, counts: make(map[string]int), suppressed: make(map[string]int)}
+}
+
+func (sampler *logSampler) logf(err error, format string, args ...interface{}) {
+	if sampler == nil || sampler.threshold <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+	category := errorCategory(err)
+	sampler.counts[category]++
+	if sampler.counts[category] <= sampler.threshold {
+		log.Printf(format, args...)
+		return
+	}
+	if sampler.suppressed[category] == 0 {
+		sampler.categories = append(sampler.categories, category)
+	}
+	sampler.suppressed[category]++
+}
+
+// summary logs the number of errors suppressed in each category
+func (sampler *logSampler) summary() {
+	if sampler == nil {
+		return
+	}
+	for _, category := range sampler.categories {
+		log.Printf("Suppressed %v similar errors: %v", sampler.suppressed[category], category)
+	}
+}
+
+// errorCategory groups the errors by the type of the innermost error and by
+// status code for the zts and zms errors
+func errorCategory(err error) string {
+	for {
+		inner := errors.Unwrap(err)
+		if inner == nil {
+			break
+		}
+		err = inner
+	}
+	if resourceErr, ok := err.(rdl.ResourceError); ok {
+		return fmt.Sprintf("%T %v", resourceErr, resourceErr.Code)
+	}
+	return fmt.Sprintf("%T", err)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestUpdatePoliciesLogSampleThreshold(t *testing.T) {
+	a := assert.New(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{})
+	defer server.Close()
+
+	domains := []string{}
+	for i := 0; i < 10; i++ {
+		domains = append(domains, fmt.Sprintf("sampled%d", i))
+	}
+	config := getServerConfiguration(server, strings.Join(domains, ","))
+	config.LogSampleThreshold = 3
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal(domains, result.FailedDomains, "Suppressed errors still fail their domains")
+	a.Equal(3, strings.Count(logs.String(), "Failed to get policies for domain: "))
+	a.True(strings.Contains(logs.String(), "Failed to get policies for domain: sampled2,"))
+	a.False(strings.Contains(logs.String(), "Failed to get policies for domain: sampled3,"))
+	a.True(strings.Contains(logs.String(), "Suppressed 7 similar errors: rdl.ResourceError 404"))
+
+	logs.Reset()
+	config.LogSampleThreshold = 0
+	_, err = UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal(10, strings.Count(logs.String(), "Failed to get policies for domain: "), "Every error is logged without sampling")
+	a.False(strings.Contains(logs.String(), "Suppressed"))
+}
+
+func TestLogSamplerCategories(t *testing.T) {
+	a := assert.New(t)
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	sampler := newLogSampler(1)
+	timeout := &VerifyTimeoutError{}
+	for i := 0; i < 3; i++ {
+		sampler.logf(fmt.Errorf("wrapped, Error:%w", timeout), "timeout %v", i)
+		sampler.logf(errors.New("other"), "other %v", i)
+	}
+	sampler.summary()
+	a.Equal(1, strings.Count(logs.String(), "timeout "), "Errors are grouped by their innermost error")
+	a.Equal(1, strings.Count(logs.String(), "other "))
+	a.True(strings.Contains(logs.String(), "Suppressed 2 similar errors: *zpu.VerifyTimeoutError"))
+	a.True(strings.Contains(logs.String(), "Suppressed 2 similar errors: *errors.errorString"))
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// domainMetricsPoster posts the metrics of a domain, to a single zts client
+// or to the metricsEndpoints
+type domainMetricsPoster interface {
+	PostDomainMetrics(domainName zts.DomainName, req *zts.DomainMetrics) (*zts.DomainMetrics, error)
+}
+
+// metricsEndpoints posts the metrics of a domain to every endpoint, the post
+// succeeds once one endpoint, or every endpoint with requireAll, accepted
+// them. A failed post keeps the metric files so endpoints that accepted the
+// metrics receive them again on the next run.
+type metricsEndpoints struct {
+	urls       []string
+	clients    []zts.ZTSClient
+	requireAll bool
+}
+
+func newMetricsEndpoints(urls []string, transport http.RoundTripper, requireAll bool) *metricsEndpoints {
+	endpoints := &metricsEndpoints{urls: urls, requireAll: requireAll}
+	for _, url := range urls {
+		endpoints.clients = append(endpoints.clients, zts.NewClient(formatUrl(url, "zts/v1"), transport))
+	}
+	return endpoints
+}
+
+func (endpoints *metricsEndpoints) PostDomainMetrics(domainName zts.DomainName, req *zts.DomainMetrics) (*zts.DomainMetrics, error) {
+	var firstErr error
+	posted := 0
+	for i, client := range endpoints.clients {
+		_, err := client.PostDomainMetrics(domainName, req)
+		if err != nil {
+			log.Printf("Failed to post metrics for domain %v to %v, Error:%v", domainName, endpoints.urls[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		posted++
+	}
+	if posted == 0 || (endpoints.requireAll && firstErr != nil) {
+		return nil, fmt.Errorf("Metrics for domain %v posted to %v of %v endpoints, Error:%v", domainName, posted, len(endpoints.clients), firstErr)
+	}
+	return req, nil
+}
+
+// postDomainMetricBatches posts the aggregated metrics split into batches of
+// batchSize domains, with up to concurrency batches posted at the same time.
+// Each batch posts its domains in order and stops at its first failure, the
+// metric files of a domain are deleted once its metrics are posted. A
+// batchSize of 0 puts all domains in a single batch. Only the maxFiles
+// oldest metric files are processed when maxFiles is set.
+func postDomainMetricBatches(ztsClient domainMetricsPoster, metricFilePath string, batchSize, concurrency, maxFiles int, parseKey metricFileKeyParser) error {
+	files, err := metricFilesForRun(metricFilePath, maxFiles)
+	if err != nil {
+		return err
+	}
+	m, err := aggregateMetricFiles(metricFilePath, files, parseKey)
+	if err != nil {
+		return err
+	}
+	domainFiles := domainMetricFiles(files, parseKey)
+	if m == nil {
+		return nil
+	}
+	domains := make([]string, 0, len(m))
+	for domain := range m {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	workers := newSemaphore(concurrency)
+	var mutex sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	for _, batch := range metricBatches(domains, batchSize) {
+		wg.Add(1)
+		workers.acquire()
+		go func(batch []string) {
+			defer wg.Done()
+			defer workers.release()
+			err := postDomainMetricBatch(ztsClient, metricFilePath, batch, m, domainFiles)
+			if err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}(batch)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// metricBatches splits the domains into consecutive batches of size domains
+func metricBatches(domains []string, size int) [][]string {
+	if size <= 0 || size > len(domains) {
+		size = len(domains)
+	}
+	batches := [][]string{}
+	for start := 0; start < len(domains); start += size {
+		end := start + size
+		if end > len(domains) {
+			end = len(domains)
+		}
+		batches = append(batches, domains[start:end])
+	}
+	return batches
+}
+
+func postDomainMetricBatch(ztsClient domainMetricsPoster, metricFilePath string, batch []string, m map[string]map[string]int, domainFiles map[string][]string) error {
+	for _, domain := range batch {
+		data, err := buildDomainMetrics(domain, m[domain])
+		if err != nil {
+			return err
+		}
+		log.Printf("Posting Domain metric for domain %v to Zts", domain)
+		_, err = ztsClient.PostDomainMetrics(zts.DomainName(domain), data)
+		if err != nil {
+			log.Printf("Failed to post metrics for domain %v to Zts", domain)
+			return err
+		}
+		deleteMetricFiles(metricFilePath, domain, domainFiles[domain])
+	}
+	return nil
+}
+
+// domainMetricsAggregated is called once the metric files of a domain are
+// aggregated, tests replace it to follow the metrics held in memory
+var domainMetricsAggregated = func(domain string) {}
+
+type aggregatedDomainMetrics struct {
+	domain string
+	data   *zts.DomainMetrics
+}
+
+// postDomainMetricPipeline aggregates the metric files one domain at a time
+// and queues the metrics of up to depth domains for the concurrency posting
+// workers. The aggregation blocks while the queue is full, so a slow zts
+// bounds the metrics held in memory instead of the whole directory being
+// aggregated up front. A failed domain keeps its metric files and does not
+// stop the other domains, the first error is returned.
+func postDomainMetricPipeline(ztsClient domainMetricsPoster, metricFilePath string, depth, concurrency, maxFiles int, parseKey metricFileKeyParser) error {
+	files, err := metricFilesForRun(metricFilePath, maxFiles)
+	if err != nil {
+		return err
+	}
+	domainFiles := domainMetricFiles(files, parseKey)
+	domains := make([]string, 0, len(domainFiles))
+	for domain := range domainFiles {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	queue := make(chan aggregatedDomainMetrics, depth)
+	var mutex sync.Mutex
+	var firstErr error
+	setErr := func(err error) {
+		mutex.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mutex.Unlock()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for metrics := range queue {
+				log.Printf("Posting Domain metric for domain %v to Zts", metrics.domain)
+				_, err := ztsClient.PostDomainMetrics(zts.DomainName(metrics.domain), metrics.data)
+				if err != nil {
+					log.Printf("Failed to post metrics for domain %v to Zts", metrics.domain)
+					setErr(err)
+					continue
+				}
+				deleteMetricFiles(metricFilePath, metrics.domain, domainFiles[metrics.domain])
+			}
+		}()
+	}
+	for _, domain := range domains {
+		m, err := aggregateDomainMetricFiles(metricFilePath, domainFiles[domain])
+		if err == nil {
+			var data *zts.DomainMetrics
+			data, err = buildDomainMetrics(domain, m)
+			if err == nil {
+				domainMetricsAggregated(domain)
+				queue <- aggregatedDomainMetrics{domain: domain, data: data}
+				continue
+			}
+		}
+		setErr(err)
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// emptyMetricsDir reports whether the metrics directory has no files, an
+// unreadable directory is left for the posting to report
+func emptyMetricsDir(metricFilePath string) bool {
+	files, err := ioutil.ReadDir(metricFilePath)
+	return err == nil && len(files) == 0
+}
+
+// metricFilesForRun returns the metric files processed by this run, the
+// maxFiles oldest ones when maxFiles is set so that a large backlog is
+// worked off over several runs
+func metricFilesForRun(metricFilePath string, maxFiles int) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(metricFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if maxFiles <= 0 || len(files) <= maxFiles {
+		return files, nil
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+	log.Printf("Processing %v of %v metric files, the others are left for the next run", maxFiles, len(files))
+	return files[:maxFiles], nil
+}
+
+// metricFileKeyParser returns the domain of a metric file from its name,
+// ok is false for files that are not metric files
+type metricFileKeyParser func(filename string) (domain string, ok bool)
+
+// defaultMetricFileKey parses the <domain>_<suffix> metric file names, the
+// domain ends at the first underscore as zpe names the files. Domains with
+// underscores need a MetricFileKeyParser.
+func defaultMetricFileKey(filename string) (string, bool) {
+	i := strings.Index(filename, "_")
+	if i <= 0 {
+		return "", false
+	}
+	return filename[:i], true
+}
+
+func (config *ZpuConfiguration) metricFileKey() metricFileKeyParser {
+	if config.MetricFileKeyParser != nil {
+		return config.MetricFileKeyParser
+	}
+	return defaultMetricFileKey
+}
+
+// domainMetricFiles returns the names of the metric files of each domain,
+// files parseKey does not parse are skipped and left in place
+func domainMetricFiles(files []os.FileInfo, parseKey metricFileKeyParser) map[string][]string {
+	domainFiles := make(map[string][]string)
+	for _, f := range files {
+		domain, ok := parseKey(f.Name())
+		if !ok {
+			log.Printf("Skipping metric file : %v with no domain in its name", f.Name())
+			continue
+		}
+		domainFiles[domain] = append(domainFiles[domain], f.Name())
+	}
+	return domainFiles
+}
+
+// deleteMetricFiles deletes the posted metric files of the domain, files
+// written since they were aggregated are kept for the next run
+func deleteMetricFiles(metricFilePath, domain string, names []string) {
+	for _, name := range names {
+		err := os.Remove(metricFilePath + "/" + name)
+		if err != nil {
+			log.Printf("Failed to delete file : %v for domain : %v", name, domain)
+		}
+	}
+}
+
+// aggregateDomainMetricFiles sums the metrics of the metric files of a domain
+func aggregateDomainMetricFiles(metricFilePath string, names []string) (map[string]int, error) {
+	m := make(map[string]int)
+	for _, name := range names {
+		data, err := ioutil.ReadFile(metricFilePath + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read metric  file : %v, Error:%v", name, err)
+		}
+		fileMap := map[string]int{}
+		err = json.Unmarshal(data, &fileMap)
+		if err != nil {
+			return nil, fmt.Errorf("Unmarshalling Error:%v for file : %v", err, name)
+		}
+		for key, value := range fileMap {
+			m[key] += value
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,415 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+const METRIC_BATCH_DIR = "/tmp/zpu_metrics_batch"
+
+func TestMetricBatches(t *testing.T) {
+	a := assert.New(t)
+	domains := []string{"d1", "d2", "d3", "d4", "d5"}
+	a.Equal([][]string{{"d1", "d2"}, {"d3", "d4"}, {"d5"}}, metricBatches(domains, 2))
+	a.Equal([][]string{{"d1", "d2", "d3", "d4", "d5"}}, metricBatches(domains, 0))
+	a.Equal([][]string{{"d1", "d2", "d3", "d4", "d5"}}, metricBatches(domains, 10))
+	a.Equal(0, len(metricBatches([]string{}, 2)))
+}
+
+func TestPostDomainMetricBatches(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	domains := []string{}
+	for i := 0; i < 7; i++ {
+		domain := fmt.Sprintf("metric%d", i)
+		domains = append(domains, domain)
+		for _, suffix := range []string{"000", "001"} {
+			file := fmt.Sprintf("%s/%s_%s.json", METRIC_BATCH_DIR, domain, suffix)
+			require.Nil(t, ioutil.WriteFile(file, []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+		}
+	}
+
+	var mutex sync.Mutex
+	posted := []string{}
+	active, maxActive := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		posted = append(posted, strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/"))
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mutex.Lock()
+		active--
+		mutex.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	err := postDomainMetricBatches(ztsClient, METRIC_BATCH_DIR, 3, 2, 0, defaultMetricFileKey)
+	a.Nil(err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sort.Strings(posted)
+	a.Equal(domains, posted, "Every domain is posted once")
+	a.True(maxActive <= 2, "At most two batches are posted at the same time")
+	a.True(maxActive > 1, "Batches are posted concurrently")
+	files, err := ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	a.Equal(0, len(files), "The metric files of posted domains are deleted")
+}
+
+func TestPostDomainMetricBatchesFailure(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	for _, domain := range []string{"metric0", "metric1", "metric2", "metric3"} {
+		file := fmt.Sprintf("%s/%s_000.json", METRIC_BATCH_DIR, domain)
+		require.Nil(t, ioutil.WriteFile(file, []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/metric0") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	err := postDomainMetricBatches(ztsClient, METRIC_BATCH_DIR, 2, 2, 0, defaultMetricFileKey)
+	a.NotNil(err)
+	remaining := []string{}
+	files, err := ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	for _, f := range files {
+		remaining = append(remaining, f.Name())
+	}
+	a.Equal([]string{"metric0_000.json", "metric1_000.json"}, remaining, "Only the failed batch keeps its metric files")
+}
+
+func TestPostDomainMetricPipeline(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	domains := []string{}
+	for i := 0; i < 10; i++ {
+		domain := fmt.Sprintf("queued%d", i)
+		domains = append(domains, domain)
+		for _, suffix := range []string{"000", "001"} {
+			file := fmt.Sprintf("%s/%s_%s.json", METRIC_BATCH_DIR, domain, suffix)
+			require.Nil(t, ioutil.WriteFile(file, []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+		}
+	}
+
+	var mutex sync.Mutex
+	posted := []string{}
+	aggregated, maxOutstanding := 0, 0
+	defer func() { domainMetricsAggregated = func(string) {} }()
+	domainMetricsAggregated = func(domain string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		aggregated++
+		if outstanding := aggregated - len(posted); outstanding > maxOutstanding {
+			maxOutstanding = outstanding
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		posted = append(posted, strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/"))
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	err := postDomainMetricPipeline(ztsClient, METRIC_BATCH_DIR, 2, 1, 0, defaultMetricFileKey)
+	a.Nil(err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	sort.Strings(posted)
+	a.Equal(domains, posted, "Every domain is eventually posted")
+	a.True(maxOutstanding <= 4, "The aggregation waits for the slow posts")
+	files, err := ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	a.Equal(0, len(files), "The metric files of posted domains are deleted")
+}
+
+func TestMaxMetricFilesPerRun(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	//oldest first: limited0_000, limited1_000, limited0_001, limited1_001, limited2_000
+	names := []string{"limited0_000", "limited1_000", "limited0_001", "limited1_001", "limited2_000"}
+	start := time.Now().Add(-time.Hour)
+	for i, name := range names {
+		file := fmt.Sprintf("%s/%s.json", METRIC_BATCH_DIR, name)
+		require.Nil(t, ioutil.WriteFile(file, []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+		modTime := start.Add(time.Duration(i) * time.Minute)
+		require.Nil(t, os.Chtimes(file, modTime, modTime))
+	}
+
+	var mutex sync.Mutex
+	posted := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		posted[strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/")] = string(body)
+		mutex.Unlock()
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	err := postDomainMetricBatches(ztsClient, METRIC_BATCH_DIR, 0, 1, 3, defaultMetricFileKey)
+	a.Nil(err)
+	mutex.Lock()
+	a.Equal(2, len(posted), "Only the domains of the oldest files are posted")
+	a.True(strings.Contains(posted["limited0"], `"metricVal":2`))
+	a.True(strings.Contains(posted["limited1"], `"metricVal":1`))
+	mutex.Unlock()
+	files, err := ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	left := []string{}
+	for _, f := range files {
+		left = append(left, f.Name())
+	}
+	a.Equal([]string{"limited1_001.json", "limited2_000.json"}, left, "The newer files are left for the next run")
+
+	err = postDomainMetricPipeline(ztsClient, METRIC_BATCH_DIR, 1, 1, 1, defaultMetricFileKey)
+	a.Nil(err)
+	files, err = ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	a.Equal(1, len(files))
+	a.Equal("limited2_000.json", files[0].Name())
+}
+
+func TestMetricFileKeyParser(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	names := []string{"zpe-java.sports_api.json", "zpe-go.sports_api.json", "zpe-go.weather.json", "README"}
+	for _, name := range names {
+		require.Nil(t, ioutil.WriteFile(METRIC_BATCH_DIR+"/"+name, []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+	}
+
+	var mutex sync.Mutex
+	posted := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		posted[strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/")] = string(body)
+		mutex.Unlock()
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	//<source>.<domain>.json with a dotless source and domain
+	config := &ZpuConfiguration{MetricFileKeyParser: func(filename string) (string, bool) {
+		parts := strings.Split(filename, ".")
+		if len(parts) != 3 || parts[2] != "json" {
+			return "", false
+		}
+		return parts[1], true
+	}}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), nil)
+	err := postDomainMetricBatches(ztsClient, METRIC_BATCH_DIR, 0, 1, 0, config.metricFileKey())
+	a.Nil(err)
+	mutex.Lock()
+	a.Equal(2, len(posted))
+	a.True(strings.Contains(posted["sports_api"], `"metricVal":2`))
+	a.True(strings.Contains(posted["weather"], `"metricVal":1`))
+	mutex.Unlock()
+	files, err := ioutil.ReadDir(METRIC_BATCH_DIR)
+	a.Nil(err)
+	a.Equal(1, len(files))
+	a.Equal("README", files[0].Name(), "Files the parser skips are left in place")
+
+	domain, ok := (&ZpuConfiguration{}).metricFileKey()("sports_api_000.json")
+	a.True(ok)
+	a.Equal("sports", domain, "The default parser ends the domain at the first underscore")
+	_, ok = defaultMetricFileKey("README")
+	a.False(ok)
+}
+
+func TestMetricsEndpoints(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+
+	var mutex sync.Mutex
+	received := map[string][]string{}
+	failing := map[string]bool{}
+	startEndpoint := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if failing[name] {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			received[name] = append(received[name], strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/"))
+			w.Write(body)
+		}))
+	}
+	primary := startEndpoint("primary")
+	defer primary.Close()
+	secondary := startEndpoint("secondary")
+	defer secondary.Close()
+	urls := []string{primary.URL, secondary.URL}
+	writeMetricFile := func() {
+		require.Nil(t, ioutil.WriteFile(METRIC_BATCH_DIR+"/redundant_000.json", []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+	}
+	metricFileExists := func() bool {
+		_, err := os.Stat(METRIC_BATCH_DIR + "/redundant_000.json")
+		return err == nil
+	}
+
+	writeMetricFile()
+	err := postDomainMetricBatches(newMetricsEndpoints(urls, nil, false), METRIC_BATCH_DIR, 0, 1, 0, defaultMetricFileKey)
+	a.Nil(err)
+	mutex.Lock()
+	a.Equal([]string{"redundant"}, received["primary"])
+	a.Equal([]string{"redundant"}, received["secondary"], "Every endpoint receives the metrics")
+	failing["secondary"] = true
+	mutex.Unlock()
+	a.False(metricFileExists())
+
+	writeMetricFile()
+	err = postDomainMetricBatches(newMetricsEndpoints(urls, nil, false), METRIC_BATCH_DIR, 0, 1, 0, defaultMetricFileKey)
+	a.Nil(err)
+	a.False(metricFileExists(), "The files are deleted once one endpoint accepted the metrics")
+
+	writeMetricFile()
+	err = postDomainMetricBatches(newMetricsEndpoints(urls, nil, true), METRIC_BATCH_DIR, 0, 1, 0, defaultMetricFileKey)
+	a.NotNil(err)
+	a.True(metricFileExists(), "The files are kept until every endpoint accepted the metrics")
+	mutex.Lock()
+	a.Equal(3, len(received["primary"]))
+	a.Equal(1, len(received["secondary"]))
+	failing["primary"] = true
+	mutex.Unlock()
+
+	err = postDomainMetricBatches(newMetricsEndpoints(urls, nil, false), METRIC_BATCH_DIR, 0, 1, 0, defaultMetricFileKey)
+	a.NotNil(err)
+	a.True(metricFileExists(), "The files are kept when no endpoint accepted the metrics")
+}
+
+func TestEmptyMetricsDir(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("nometrics", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"nometrics": data})
+	defer server.Close()
+	defer removePolicyFiles("nometrics")
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := getServerConfiguration(server, "nometrics")
+	config.MetricsDir = METRIC_BATCH_DIR
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.True(strings.Contains(logs.String(), "No metrics to post, metrics directory: "+METRIC_BATCH_DIR+" is empty"))
+
+	logs.Reset()
+	config.QuietEmptyMetrics = true
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "No metrics to post"))
+
+	config.MetricsDir = ""
+	config.QuietEmptyMetrics = false
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.False(strings.Contains(logs.String(), "No metrics to post"), "Nothing is logged when metrics are disabled")
+}
+
+func TestMetricsShareClientTransport(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("shared1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	require.Nil(t, os.MkdirAll(METRIC_BATCH_DIR, 0755))
+	defer os.RemoveAll(METRIC_BATCH_DIR)
+	require.Nil(t, ioutil.WriteFile(METRIC_BATCH_DIR+"/shared1_000.json", []byte(`{"ACCESS_ALLOWED":1}`), 0755))
+	defer removePolicyFiles("shared1")
+	removePolicyFiles("shared1")
+
+	policies := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"shared1": data})
+	defer policies.Close()
+	var mutex sync.Mutex
+	connections := 0
+	posted := []string{}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/zts/v1/metrics/") {
+			policies.ServeHTTP(w, r)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		mutex.Lock()
+		posted = append(posted, strings.TrimPrefix(r.URL.Path, "/zts/v1/metrics/"))
+		mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mutex.Lock()
+			connections++
+			mutex.Unlock()
+		}
+	}
+	server.Start()
+	defer server.Close()
+
+	config := getServerConfiguration(policies, "shared1")
+	config.Zts = server.URL
+	config.Zms = server.URL
+	config.MetricsDir = METRIC_BATCH_DIR
+	clients := buildClients(config)
+	a.True(clients.zts.Transport == clients.zms.Transport)
+	a.True(clients.metricsPoster(config) == clients.zts)
+	config.MetricsEndpoints = []string{server.URL}
+	a.True(clients.metricsPoster(config).(*metricsEndpoints).clients[0].Transport == clients.transport)
+
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"shared1"}, result.UpdatedDomains)
+	mutex.Lock()
+	defer mutex.Unlock()
+	a.Equal([]string{"shared1"}, posted)
+	a.Equal(1, connections, "The policy and metrics requests reuse the connection")
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// MigratePolicyFiles rewrites the policy files of the policy directory with
+// the fromExt extension and fromEncoding encoding in the current format, then
+// removes them. Every file is validated before it is rewritten, a file that
+// does not validate is left in place. The policy files are only written in
+// json so json, or "", is the only encoding that can be migrated.
+func MigratePolicyFiles(config *ZpuConfiguration, fromExt, fromEncoding string) error {
+	if config == nil {
+		return errors.New("Nil configuration")
+	}
+	if fromEncoding != "" && fromEncoding != "json" {
+		return fmt.Errorf("Unsupported policy file encoding: %v", fromEncoding)
+	}
+	if fromExt == "" || fromExt == config.policyFileExt() {
+		return nil
+	}
+	policyFileDir := config.policyDir()
+	files, err := ioutil.ReadDir(policyFileDir)
+	if err != nil {
+		return err
+	}
+	zmsClient := buildClients(config).zms
+	failedFiles := ""
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), fromExt) {
+			continue
+		}
+		oldFile := policyFileDir + "/" + f.Name()
+		domain := strings.TrimSuffix(f.Name(), fromExt)
+		err := migratePolicyFile(config, zmsClient, oldFile, domain, policyFileDir)
+		if err != nil {
+			log.Printf("Unable to migrate policy file: %v, Error:%v", oldFile, err)
+			failedFiles += `"` + oldFile + `" `
+			continue
+		}
+		log.Printf("Policy file: %v migrated to %v", oldFile, config.policyFile(policyFileDir, domain))
+	}
+	if failedFiles != "" {
+		return fmt.Errorf("Failed to migrate policy files: %v", failedFiles)
+	}
+	return nil
+}
+
+// migratePolicyFile rewrites the old policy file of the domain, an existing
+// policy file in the current format is newer and is kept
+func migratePolicyFile(config *ZpuConfiguration, zmsClient zms.ZMSClient, oldFile, domain, policyFileDir string) error {
+	if !util.Exists(config.policyFile(policyFileDir, domain)) {
+		data, err := readPolicyFile(config, oldFile)
+		if err != nil {
+			return err
+		}
+		err = ValidateSignedPolicies(config, zmsClient, data)
+		if err != nil {
+			return err
+		}
+		err = WritePolicies(config, data, domain, policyFileDir)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Remove(oldFile)
+}
@@ -0,0 +1,53 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestMigratePolicyFiles(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("migrate", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.PolicyFileDir = POLICIES_DIR
+	require.Nil(t, WritePolicies(config, data, "migrate", POLICIES_DIR))
+	oldFile := POLICIES_DIR + "/migrate.pol"
+	newFile := POLICIES_DIR + "/migrate.json"
+	defer os.Remove(oldFile)
+	defer os.Remove(newFile)
+	original, err := ioutil.ReadFile(oldFile)
+	require.Nil(t, err)
+	//an old file that does not validate is kept
+	invalidFile := POLICIES_DIR + "/migrateinvalid.pol"
+	require.Nil(t, ioutil.WriteFile(invalidFile, []byte(`{}`), 0644))
+	defer os.Remove(invalidFile)
+
+	config.PolicyFileExtension = ".json"
+	err = MigratePolicyFiles(config, ".pol", "json")
+	a.NotNil(err)
+	a.Equal(util.Exists(oldFile), false)
+	a.Equal(util.Exists(invalidFile), true)
+	content, err := ioutil.ReadFile(newFile)
+	a.Nil(err)
+	a.Equal(string(original), string(content))
+	migrated, err := readPolicyFile(config, newFile)
+	a.Nil(err)
+	a.Equal(data.SignedPolicyData.Modified.String(), migrated.SignedPolicyData.Modified.String())
+	a.Equal(data.Signature, migrated.Signature)
+	a.Nil(ValidateSignedPolicies(config, zmsClientForTest(), migrated))
+
+	os.Remove(invalidFile)
+	a.Nil(MigratePolicyFiles(config, ".pol", ""))
+	a.NotNil(MigratePolicyFiles(config, ".pol", "yaml"))
+}
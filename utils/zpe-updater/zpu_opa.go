@@ -0,0 +1,119 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// opaData is the OPA data document of a domain, its assertions flattened
+// so that a Rego rule can match them without walking the policies
+type opaData struct {
+	Domain     string         `json:"domain"`
+	Modified   string         `json:"modified"`
+	Expires    string         `json:"expires"`
+	Assertions []opaAssertion `json:"assertions"`
+}
+
+type opaAssertion struct {
+	Policy   string `json:"policy"`
+	Role     string `json:"role"`
+	Action   string `json:"action"`
+	Resource string `json:"resource"`
+	Effect   string `json:"effect"`
+}
+
+// newOpaData flattens the validated policy data of the domain, assertions
+// without an effect allow like they do for zpe
+func newOpaData(data *zts.DomainSignedPolicyData, domain string) *opaData {
+	signedPolicyData := data.SignedPolicyData
+	document := &opaData{
+		Domain:     domain,
+		Modified:   signedPolicyData.Modified.String(),
+		Expires:    signedPolicyData.Expires.String(),
+		Assertions: []opaAssertion{},
+	}
+	if signedPolicyData.PolicyData == nil {
+		return document
+	}
+	for _, policy := range signedPolicyData.PolicyData.Policies {
+		if policy == nil {
+			continue
+		}
+		for _, assertion := range policy.Assertions {
+			if assertion == nil {
+				continue
+			}
+			effect := zts.ALLOW
+			if assertion.Effect != nil {
+				effect = *assertion.Effect
+			}
+			document.Assertions = append(document.Assertions, opaAssertion{
+				Policy:   string(policy.Name),
+				Role:     assertion.Role,
+				Action:   assertion.Action,
+				Resource: assertion.Resource,
+				Effect:   effect.String(),
+			})
+		}
+	}
+	return document
+}
+
+// opaDataDir returns the OpaDataDir of the environment
+func (config *ZpuConfiguration) opaDataDir() string {
+	return environmentDir(config.OpaDataDir, config.Environment)
+}
+
+// opaDataFile is the OPA data document of the domain in the OpaDataDir
+func opaDataFile(config *ZpuConfiguration, domain string) string {
+	return fmt.Sprintf("%s/%s.json", config.opaDataDir(), domain)
+}
+
+// writeOpaData writes the OPA data document of the domain once its policy
+// file is written. The document is written next to its final name and
+// renamed into place so OPA never loads a partial document.
+func writeOpaData(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain string) error {
+	bytes, err := json.Marshal(newOpaData(data, domain))
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(config.opaDataDir(), 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create OPA data directory: %v, Error:%v", config.opaDataDir(), err)
+	}
+	opaFile := opaDataFile(config, domain)
+	tempFile := opaFile + ".tmp"
+	err = ioutil.WriteFile(tempFile, bytes, 0644)
+	if err == nil {
+		err = os.Rename(tempFile, opaFile)
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return fmt.Errorf("Unable to write OPA data of domain: %v, Error:%v", domain, err)
+	}
+	return nil
+}
+
+// ensureOpaData writes the missing OPA data document of a domain whose
+// validated stored policies are kept, e.g. when zts answers not modified
+// after the OpaDataDir was configured or its document was removed
+func ensureOpaData(config *ZpuConfiguration, domain, policyFileDir string) error {
+	if config.OpaDataDir == "" || util.Exists(opaDataFile(config, domain)) {
+		return nil
+	}
+	data, err := readPolicyFile(config, config.policyFile(policyFileDir, domain))
+	if err != nil {
+		return fmt.Errorf("Unable to read stored policies for the OPA data of domain: %v, Error:%v", domain, err)
+	}
+	log.Printf("Writing missing OPA data of domain: %v from its stored policies", domain)
+	return writeOpaData(config, data, domain)
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestOpaDataDir(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("opa1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"opa1": data})
+	defer server.Close()
+	defer removePolicyFiles("opa1")
+	opaDir, err := ioutil.TempDir("", "zpu_opa")
+	require.Nil(t, err)
+	defer os.RemoveAll(opaDir)
+
+	config := getServerConfiguration(server, "opa1,opa2")
+	config.OpaDataDir = opaDir
+	_, err = UpdatePolicies(config)
+	a.NotNil(err, "opa2 is not served by zts")
+	a.False(util.Exists(opaDir+"/opa2.json"), "Only written policies are exported")
+	a.False(util.Exists(opaDir + "/opa1.json.tmp"))
+
+	bytes, err := ioutil.ReadFile(opaDir + "/opa1.json")
+	require.Nil(t, err)
+	var document map[string]interface{}
+	require.Nil(t, json.Unmarshal(bytes, &document))
+	a.Equal("opa1", document["domain"])
+	a.Equal(data.SignedPolicyData.Expires.String(), document["expires"])
+	a.Equal([]interface{}{
+		map[string]interface{}{
+			"policy":   "opa1:policy.admin",
+			"role":     "opa1:role.admin",
+			"action":   "*",
+			"resource": "opa1:*",
+			"effect":   "ALLOW",
+		},
+	}, document["assertions"])
+}
+
+func TestNewOpaData(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("opa3", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	deny := zts.DENY
+	policies := data.SignedPolicyData.PolicyData.Policies
+	policies[0].Assertions = append(policies[0].Assertions,
+		&zts.Assertion{Role: "opa3:role.reader", Resource: "opa3:secret", Action: "read", Effect: &deny},
+		&zts.Assertion{Role: "opa3:role.reader", Resource: "opa3:public", Action: "read"})
+
+	document := newOpaData(data, "opa3")
+	require.Equal(t, 3, len(document.Assertions))
+	a.Equal(opaAssertion{Policy: "opa3:policy.admin", Role: "opa3:role.reader", Action: "read", Resource: "opa3:secret", Effect: "DENY"}, document.Assertions[1])
+	a.Equal("ALLOW", document.Assertions[2].Effect, "Assertions without an effect allow")
+}
+
+func TestOpaDataEnvironment(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("opaenv", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"opaenv": data})
+	defer server.Close()
+	defer os.RemoveAll(POLICIES_DIR + "/prod")
+	opaDir, err := ioutil.TempDir("", "zpu_opa")
+	require.Nil(t, err)
+	defer os.RemoveAll(opaDir)
+
+	config := getServerConfiguration(server, "opaenv")
+	config.Environment = "prod"
+	config.OpaDataDir = opaDir
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.True(util.Exists(opaDir+"/prod/opaenv.json"), "Each environment exports its own documents")
+	a.False(util.Exists(opaDir + "/opaenv.json"))
+}
+
+func TestOpaDataNotModified(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("opa4", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"opa4": data})
+	defer server.Close()
+	defer removePolicyFiles("opa4")
+	removePolicyFiles("opa4")
+	opaDir, err := ioutil.TempDir("", "zpu_opa")
+	require.Nil(t, err)
+	defer os.RemoveAll(opaDir)
+
+	config := getServerConfiguration(server, "opa4")
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+
+	config.OpaDataDir = opaDir
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"opa4"}, result.NotModifiedDomains)
+	bytes, err := ioutil.ReadFile(opaDir + "/opa4.json")
+	require.Nil(t, err, "The missing document is written from the stored policies")
+	var document map[string]interface{}
+	require.Nil(t, json.Unmarshal(bytes, &document))
+	a.Equal("opa4", document["domain"])
+	a.Equal(data.SignedPolicyData.Modified.String(), document["modified"])
+
+	require.Nil(t, os.Remove(opaDir+"/opa4.json"))
+	config.ReadOnlyUntil = now.Add(time.Hour)
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.False(util.Exists(opaDir+"/opa4.json"), "Nothing is written in read-only mode")
+}
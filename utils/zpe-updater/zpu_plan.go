@@ -0,0 +1,137 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ardielle/ardielle-go/rdl"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+const (
+	PLAN_FULL_FETCH        = "full-fetch"
+	PLAN_CONDITIONAL_FETCH = "conditional-fetch"
+	PLAN_SKIP              = "skip"
+	PLAN_FAIL              = "fail"
+)
+
+// PlanEntry describes how a run would fetch the policies of a domain
+type PlanEntry struct {
+	Domain string `json:"domain"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+	// expires is the expiry of the stored policies, zero when not read
+	expires rdl.Timestamp
+	err     error
+}
+
+// planDomain decides how the policies of the domain are fetched from the
+// expiry and modified time of the stored policy file alone, without
+// contacting zts or zms. The stored policies are only validated by the run
+// that uses their etag.
+func planDomain(config *ZpuConfiguration, domain, policyFileDir string) *PlanEntry {
+	plan := &PlanEntry{Domain: domain}
+	policyFile := config.policyFile(policyFileDir, domain)
+	if err := policyPathIsDirectory(policyFile); err != nil {
+		if !config.RemoveStrayPolicyDirs {
+			plan.Action = PLAN_FAIL
+			plan.Reason = fmt.Sprintf("stored policies are not usable: %v", err)
+			plan.err = err
+			return plan
+		}
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = "a stray directory at the policy file path is removed by the write"
+		return plan
+	}
+	switch {
+	case !util.Exists(policyFile):
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = "no stored policy file"
+		return plan
+	case config.RefuseWorldWritablePolicies && worldWritablePolicy(policyFile) != "":
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = fmt.Sprintf("stored policies are refused, %v", worldWritablePolicy(policyFile))
+		return plan
+	case util.Exists(modifiedMarkerFile(policyFile)):
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = "stored policies were modified by the post validation transform"
+		return plan
+	}
+	stored, err := readPolicyFile(config, policyFile)
+	if err != nil {
+		plan.Action = PLAN_FAIL
+		plan.Reason = fmt.Sprintf("stored policies are not usable: %v", err)
+		plan.err = err
+		return plan
+	}
+	expires := stored.SignedPolicyData.Expires
+	plan.expires = expires
+	if expiredAt(config.GetClock().Now(), rdl.NewTimestamp(expires.Time.Add(time.Duration(int64(config.StartUpDelay))*time.Second))) {
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = fmt.Sprintf("stored policies expired on %v", expires)
+		return plan
+	}
+	if stored.SignedPolicyData.Modified.IsZero() {
+		plan.Action = PLAN_FULL_FETCH
+		plan.Reason = "stored policies have no modified time to build an etag"
+		return plan
+	}
+	if config.RefreshIfExpiresWithin > 0 && expires.Time.After(config.GetClock().Now().Add(config.RefreshIfExpiresWithin)) {
+		plan.Action = PLAN_SKIP
+		plan.Reason = fmt.Sprintf("stored policies are fresh until %v", expires)
+		return plan
+	}
+	plan.Action = PLAN_CONDITIONAL_FETCH
+	if config.RefreshIfExpiresWithin > 0 {
+		plan.Reason = fmt.Sprintf("stored policies expire on %v within the refresh window", expires)
+	} else {
+		plan.Reason = fmt.Sprintf("stored policies expire on %v", expires)
+	}
+	return plan
+}
+
+// planPolicies returns the fetch plan of every domain and logs it
+func planPolicies(config *ZpuConfiguration, domains []string) []*PlanEntry {
+	plans := make([]*PlanEntry, 0, len(domains))
+	for _, domain := range domains {
+		plan := planDomain(config, domain, config.policyDir())
+		log.Printf("Plan for domain: %v is %v, %v", domain, plan.Action, plan.Reason)
+		plans = append(plans, plan)
+	}
+	return plans
+}
+
+// NextRefreshTime returns the earliest time a domain needs its policies
+// fetched, given the RefreshIfExpiresWithin, so that an external scheduler
+// can run the updater only then. A domain whose stored policies are not
+// skipped by the plan needs a refresh now.
+func NextRefreshTime(config *ZpuConfiguration) (time.Time, error) {
+	if config == nil {
+		return time.Time{}, errors.New("Nil configuration")
+	}
+	domains, err := ResolveDomainList(config)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(domains) == 0 {
+		return time.Time{}, errors.New("No domain list to process from configuration")
+	}
+	now := config.GetClock().Now()
+	var next time.Time
+	for _, domain := range domains {
+		refresh := now
+		plan := planDomain(config, domain, config.policyDir())
+		if plan.Action == PLAN_SKIP {
+			refresh = plan.expires.Time.Add(-config.RefreshIfExpiresWithin)
+		}
+		if next.IsZero() || refresh.Before(next) {
+			next = refresh
+		}
+	}
+	return next, nil
+}
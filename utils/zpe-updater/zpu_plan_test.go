@@ -0,0 +1,123 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestUpdatePoliciesDryRunPlan(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	fresh, err := signPolicyData("plan_fresh", now, now.Add(24*time.Hour))
+	require.Nil(t, err)
+	expiring, err := signPolicyData("plan_expiring", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"plan_fresh": fresh, "plan_expiring": expiring})
+	defer server.Close()
+	defer removePolicyFiles("plan_fresh", "plan_expiring")
+
+	config := getServerConfiguration(server, "plan_fresh,plan_expiring,plan_missing")
+	config.RefreshIfExpiresWithin = 2 * time.Hour
+	require.Nil(t, WritePolicies(config, fresh, "plan_fresh", POLICIES_DIR))
+	require.Nil(t, WritePolicies(config, expiring, "plan_expiring", POLICIES_DIR))
+
+	config.DryRunPlan = true
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	require.Equal(t, 3, len(result.Plan))
+	a.Equal("plan_fresh", result.Plan[0].Domain)
+	a.Equal(PLAN_SKIP, result.Plan[0].Action)
+	a.Equal("plan_expiring", result.Plan[1].Domain)
+	a.Equal(PLAN_CONDITIONAL_FETCH, result.Plan[1].Action)
+	a.Equal("plan_missing", result.Plan[2].Domain)
+	a.Equal(PLAN_FULL_FETCH, result.Plan[2].Action)
+	for _, plan := range result.Plan {
+		a.NotEmpty(plan.Reason)
+	}
+	a.Empty(server.RequestedDomains(), "The plan should not contact zts")
+
+	//the run follows the plan
+	config.DryRunPlan = false
+	result, err = UpdatePolicies(config)
+	a.NotNil(err, "plan_missing is not served by zts")
+	a.Equal([]string{"plan_expiring", "plan_missing"}, server.RequestedDomains())
+	a.Equal([]string{"plan_fresh", "plan_expiring"}, result.NotModifiedDomains)
+}
+
+func TestPlanDomainStoredFileOnly(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("plan_tampered", now, now.Add(24*time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{})
+	defer server.Close()
+	defer removePolicyFiles("plan_tampered")
+
+	//the plan does not verify the signature of the stored policies
+	data.Signature = "tampered"
+	bytes, err := json.Marshal(data)
+	require.Nil(t, err)
+	require.Nil(t, ioutil.WriteFile(POLICIES_DIR+"/plan_tampered.pol", bytes, 0644))
+	config := getServerConfiguration(server, "plan_tampered")
+	config.RefreshIfExpiresWithin = time.Hour
+	plan := planDomain(config, "plan_tampered", POLICIES_DIR)
+	a.Equal(PLAN_SKIP, plan.Action)
+	a.Equal(data.SignedPolicyData.Expires.String(), plan.expires.String())
+
+	//the run validates the stored policies before keeping them
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal([]string{"plan_tampered"}, result.FailedDomains)
+	a.Empty(server.RequestedDomains())
+}
+
+func TestUpdatePoliciesDryRunPlanInvalidEnvironment(t *testing.T) {
+	a := assert.New(t)
+	config := getSigningConfiguration()
+	config.DomainList = "plan_fresh"
+	config.Environment = "../prod"
+	config.DryRunPlan = true
+	result, err := UpdatePolicies(config)
+	a.Nil(result)
+	a.NotNil(err, "The environment is validated before the plan")
+}
+
+func TestNextRefreshTime(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.PolicyFileDir = POLICIES_DIR
+	config.Clock = newFakeClock(now)
+	config.RefreshIfExpiresWithin = 30 * time.Minute
+	expiries := map[string]time.Duration{"next1": 3 * time.Hour, "next2": 2 * time.Hour, "next3": 5 * time.Hour}
+	for domain, validity := range expiries {
+		data, err := signPolicyData(domain, now, now.Add(validity))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(config, data, domain, POLICIES_DIR))
+	}
+	defer removePolicyFiles("next1", "next2", "next3")
+
+	config.DomainList = "next1,next2,next3"
+	next, err := NextRefreshTime(config)
+	a.Nil(err)
+	expected := now.Add(2 * time.Hour).Add(-30 * time.Minute)
+	a.Equal(expected.UnixNano()/int64(time.Millisecond), next.UnixNano()/int64(time.Millisecond), "The earliest expiry less the refresh window")
+
+	config.DomainList = "next1,next2,next3,nextmissing"
+	next, err = NextRefreshTime(config)
+	a.Nil(err)
+	a.Equal(now, next, "A domain without stored policies needs a refresh now")
+
+	config.DomainList = ""
+	_, err = NextRefreshTime(config)
+	a.NotNil(err)
+}
@@ -0,0 +1,105 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+const LAST_SUCCESS_METRIC = "zpu_last_success_timestamp_seconds"
+
+// writePrometheusTextfile writes the metrics of the run in the prometheus
+// exposition format for the node_exporter textfile collector. The file is
+// written next to the target and renamed into place so a scrape never sees
+// a partial file.
+func writePrometheusTextfile(config *ZpuConfiguration, result *UpdateResult, domains []string, policyFileDir string, success bool) error {
+	now := config.GetClock().Now()
+	lastSuccess := readLastSuccess(config.PrometheusTextfile)
+	if success {
+		lastSuccess = float64(now.Unix())
+	}
+	var buf bytes.Buffer
+	writeGauge(&buf, "zpu_domains_updated", "Number of domains with updated policies in the last run.", float64(len(result.UpdatedDomains)))
+	writeGauge(&buf, "zpu_domains_not_modified", "Number of domains with unmodified policies in the last run.", float64(len(result.NotModifiedDomains)))
+	writeGauge(&buf, "zpu_domains_failed", "Number of domains that failed in the last run.", float64(len(result.FailedDomains)))
+	writeGauge(&buf, "zpu_last_run_timestamp_seconds", "Unix time of the last run.", float64(now.Unix()))
+	if lastSuccess > 0 {
+		writeGauge(&buf, LAST_SUCCESS_METRIC, "Unix time of the last run without failed domains.", lastSuccess)
+	}
+	if minExpiry, ok := minTimeToExpiry(config, domains, policyFileDir, now); ok {
+		writeGauge(&buf, "zpu_policy_min_time_to_expiry_seconds", "Seconds until the first stored policy file expires.", minExpiry)
+	}
+
+	tempFile := config.PrometheusTextfile + ".tmp"
+	err := ioutil.WriteFile(tempFile, buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tempFile, config.PrometheusTextfile)
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+	return nil
+}
+
+func writeGauge(buf *bytes.Buffer, name, help string, value float64) {
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(buf, "%s %s\n", name, strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+// readLastSuccess returns the last success time of a previous textfile so a
+// failed run keeps reporting when zpu last succeeded, 0 if unknown
+func readLastSuccess(path string) float64 {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == LAST_SUCCESS_METRIC {
+			value, err := strconv.ParseFloat(fields[1], 64)
+			if err == nil {
+				return value
+			}
+		}
+	}
+	return 0
+}
+
+// minTimeToExpiry returns the seconds until the first of the stored policy
+// files of the domains expires, ok is false when no policy file is stored
+func minTimeToExpiry(config *ZpuConfiguration, domains []string, policyFileDir string, now time.Time) (float64, bool) {
+	minExpiry := math.Inf(1)
+	for _, domain := range domains {
+		policyFile := config.policyFile(policyFileDir, domain)
+		if !util.Exists(policyFile) {
+			continue
+		}
+		data, err := readPolicyFile(config, policyFile)
+		if err != nil {
+			continue
+		}
+		expiry := data.SignedPolicyData.Expires.Time.Sub(now).Seconds()
+		if expiry < minExpiry {
+			minExpiry = expiry
+		}
+	}
+	if math.IsInf(minExpiry, 1) {
+		return 0, false
+	}
+	return math.Floor(minExpiry), true
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bufio"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+const PROMETHEUS_TEXTFILE = "/tmp/zpu_metrics.prom"
+
+var (
+	promComment = regexp.MustCompile(`^# (HELP|TYPE) ([a-zA-Z_:][a-zA-Z0-9_:]*) (.+)$`)
+	promSample  = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*) (\S+)$`)
+)
+
+// parsePrometheusTextfile checks every line of the exposition format and
+// returns the samples by metric name
+func parsePrometheusTextfile(t *testing.T, path string) map[string]float64 {
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+	samples := map[string]float64{}
+	types := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if match := promComment.FindStringSubmatch(line); match != nil {
+			if match[1] == "TYPE" {
+				types[match[2]] = match[3]
+			}
+			continue
+		}
+		match := promSample.FindStringSubmatch(line)
+		require.NotNil(t, match, "Invalid exposition line: "+line)
+		value, err := strconv.ParseFloat(match[2], 64)
+		require.Nil(t, err)
+		require.Equal(t, "gauge", types[match[1]], "Sample without a type: "+line)
+		samples[match[1]] = value
+	}
+	return samples
+}
+
+func TestPrometheusTextfile(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("prom1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"prom1": data})
+	defer server.Close()
+	defer removePolicyFiles("prom1")
+	defer os.Remove(PROMETHEUS_TEXTFILE)
+	os.Remove(PROMETHEUS_TEXTFILE)
+
+	config := getServerConfiguration(server, "prom1")
+	config.PrometheusTextfile = PROMETHEUS_TEXTFILE
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	samples := parsePrometheusTextfile(t, PROMETHEUS_TEXTFILE)
+	a.Equal(float64(1), samples["zpu_domains_updated"])
+	a.Equal(float64(0), samples["zpu_domains_not_modified"])
+	a.Equal(float64(0), samples["zpu_domains_failed"])
+	a.True(samples["zpu_last_run_timestamp_seconds"] >= float64(now.Unix()))
+	lastSuccess := samples[LAST_SUCCESS_METRIC]
+	a.True(lastSuccess >= float64(now.Unix()))
+	expiry, ok := samples["zpu_policy_min_time_to_expiry_seconds"]
+	a.True(ok)
+	a.True(expiry > 3500 && expiry <= 3600)
+	a.Equal(util.Exists(PROMETHEUS_TEXTFILE+".tmp"), false)
+
+	config.DomainList = "prom1,prom2"
+	_, err = UpdatePolicies(config)
+	a.NotNil(err)
+	samples = parsePrometheusTextfile(t, PROMETHEUS_TEXTFILE)
+	a.Equal(float64(1), samples["zpu_domains_not_modified"])
+	a.Equal(float64(1), samples["zpu_domains_failed"])
+	a.Equal(lastSuccess, samples[LAST_SUCCESS_METRIC], "A failed run keeps the last success time")
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"log"
+	"sort"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+// UpdateResult summarizes the outcome of an UpdatePolicies run
+type UpdateResult struct {
+	UpdatedDomains     []string `json:"updatedDomains"`
+	NotModifiedDomains []string `json:"notModifiedDomains"`
+	FailedDomains      []string `json:"failedDomains"`
+	// distinct key ids that signed the policy data fetched during the run
+	ZtsKeyIds []string `json:"ztsKeyIds"`
+	ZmsKeyIds []string `json:"zmsKeyIds"`
+	// ReadOnly is set when the run only validated the fetched policies
+	ReadOnly bool `json:"readOnly"`
+	// ModifiedDomains had their policies changed by the PostValidateTransform
+	ModifiedDomains []string `json:"modifiedDomains"`
+	// DebouncedDomains have a fetched change waiting for the WriteDebounce
+	DebouncedDomains []string `json:"debouncedDomains"`
+	// Plan is the fetch plan of every domain when DryRunPlan is configured
+	Plan []*PlanEntry `json:"plan,omitempty"`
+	// DroppedEvents counts the events dropped because EventChannel was full
+	DroppedEvents int `json:"droppedEvents"`
+	// ForeignSignedDomains have their fetched or stored policies signed by
+	// a zms key id not in the AllowedZmsKeyIds
+	ForeignSignedDomains []string `json:"foreignSignedDomains"`
+}
+
+func (result *UpdateResult) addUpdated(domain string, data *zts.DomainSignedPolicyData) {
+	result.UpdatedDomains = append(result.UpdatedDomains, domain)
+	result.ZtsKeyIds = addKeyId(result.ZtsKeyIds, data.KeyId)
+	if data.SignedPolicyData != nil {
+		result.ZmsKeyIds = addKeyId(result.ZmsKeyIds, data.SignedPolicyData.ZmsKeyId)
+	}
+}
+
+// checkZmsSigner flags the domain when its policies were signed by a zms
+// key id not in the AllowedZmsKeyIds
+func (result *UpdateResult) checkZmsSigner(config *ZpuConfiguration, domain string, data *zts.DomainSignedPolicyData) {
+	if len(config.AllowedZmsKeyIds) == 0 || data == nil || data.SignedPolicyData == nil {
+		return
+	}
+	keyId := data.SignedPolicyData.ZmsKeyId
+	for _, allowed := range config.AllowedZmsKeyIds {
+		if allowed == keyId {
+			return
+		}
+	}
+	log.Printf("Warning: policies of domain: %v are signed by the zms key id: %v, not one of the allowed zms key ids: %v", domain, keyId, config.AllowedZmsKeyIds)
+	result.ForeignSignedDomains = append(result.ForeignSignedDomains, domain)
+}
+
+// markFailed moves an updated domain to the failed domains
+func (result *UpdateResult) markFailed(domain string) {
+	for i, updated := range result.UpdatedDomains {
+		if updated == domain {
+			result.UpdatedDomains = append(result.UpdatedDomains[:i], result.UpdatedDomains[i+1:]...)
+			break
+		}
+	}
+	for i, modified := range result.ModifiedDomains {
+		if modified == domain {
+			result.ModifiedDomains = append(result.ModifiedDomains[:i], result.ModifiedDomains[i+1:]...)
+			break
+		}
+	}
+	result.FailedDomains = append(result.FailedDomains, domain)
+}
+
+// addKeyId inserts the key id into the sorted list of key ids if missing
+func addKeyId(keyIds []string, keyId string) []string {
+	i := sort.SearchStrings(keyIds, keyId)
+	if i < len(keyIds) && keyIds[i] == keyId {
+		return keyIds
+	}
+	keyIds = append(keyIds, "")
+	copy(keyIds[i+1:], keyIds[i:])
+	keyIds[i] = keyId
+	return keyIds
+}
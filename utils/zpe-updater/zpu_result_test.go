@@ -0,0 +1,112 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestUpdatePoliciesKeyIds(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data1, err := testPolicySigner("zts.0", "zms.0").Sign("keys1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	data2, err := testPolicySigner("zts.1", "zms.1").Sign("keys2", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	data3, err := testPolicySigner("zts.1", "zms.0").Sign("keys3", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"keys1": data1, "keys2": data2, "keys3": data3})
+	defer server.Close()
+	defer removePolicyFiles("keys1", "keys2", "keys3")
+
+	config := getServerConfiguration(server, "keys1,keys2,keys3,keys4")
+	config.ZtsKeysmap = map[string]string{"zts.0": testPublicKey, "zts.1": testPublicKey}
+	config.ZmsKeysmap = map[string]string{"zms.0": testPublicKey, "zms.1": testPublicKey}
+	result, err := UpdatePolicies(config)
+	a.NotNil(err, "keys4 is not served by zts")
+	require.NotNil(t, result)
+	a.Equal([]string{"keys1", "keys2", "keys3"}, result.UpdatedDomains)
+	a.Equal([]string{"keys4"}, result.FailedDomains)
+	a.Equal([]string{"zts.0", "zts.1"}, result.ZtsKeyIds)
+	a.Equal([]string{"zms.0", "zms.1"}, result.ZmsKeyIds)
+
+	//policies are not modified on the second run
+	result, err = UpdatePolicies(config)
+	require.NotNil(t, result)
+	a.Equal([]string{"keys1", "keys2", "keys3"}, result.NotModifiedDomains)
+	a.Empty(result.UpdatedDomains)
+	a.Empty(result.ZtsKeyIds)
+}
+
+func TestUpdatePoliciesReturnErrorOnPartialFailure(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("partial1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"partial1": data})
+	defer server.Close()
+	defer removePolicyFiles("partial1")
+
+	config := getServerConfiguration(server, "partial1,partial2")
+	returnError := false
+	config.ReturnErrorOnPartialFailure = &returnError
+	result, err := UpdatePolicies(config)
+	a.Nil(err, "Failures are only reported in the result")
+	require.NotNil(t, result)
+	a.Equal([]string{"partial1"}, result.UpdatedDomains)
+	a.Equal([]string{"partial2"}, result.FailedDomains)
+
+	config.ReturnErrorOnPartialFailure = nil
+	result, err = UpdatePolicies(config)
+	a.NotNil(err, "Failures return an error by default")
+	require.NotNil(t, result)
+	a.Equal([]string{"partial2"}, result.FailedDomains)
+}
+
+func TestAddKeyId(t *testing.T) {
+	a := assert.New(t)
+	var keyIds []string
+	for _, keyId := range []string{"1", "0", "2", "1", "0"} {
+		keyIds = addKeyId(keyIds, keyId)
+	}
+	a.Equal([]string{"0", "1", "2"}, keyIds)
+}
+
+func TestUpdatePoliciesForeignSignedDomains(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data1, err := testPolicySigner("0", "zms.0").Sign("signer1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	data2, err := testPolicySigner("0", "zms.foreign").Sign("signer2", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"signer1": data1, "signer2": data2})
+	defer server.Close()
+	defer removePolicyFiles("signer1", "signer2")
+	removePolicyFiles("signer1", "signer2")
+
+	config := getServerConfiguration(server, "signer1,signer2")
+	config.ZmsKeysmap = map[string]string{"zms.0": testPublicKey, "zms.foreign": testPublicKey}
+	config.AllowedZmsKeyIds = []string{"zms.0"}
+	result, err := UpdatePolicies(config)
+	a.Nil(err, "Foreign signed domains are only reported")
+	require.NotNil(t, result)
+	a.Equal([]string{"signer1", "signer2"}, result.UpdatedDomains)
+	a.Equal([]string{"signer2"}, result.ForeignSignedDomains)
+
+	//the stored policies are checked when not modified
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"signer1", "signer2"}, result.NotModifiedDomains)
+	a.Equal([]string{"signer2"}, result.ForeignSignedDomains)
+
+	config.AllowedZmsKeyIds = nil
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Empty(result.ForeignSignedDomains)
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_SIGNING_CERT_REVOCATION_TTL = time.Hour
+	SIGNING_CERT_CRL_TIMEOUT            = 10 * time.Second
+)
+
+// RevokedSigningCertError is returned when the certificate backing the zts
+// signing key is listed on the CRL of its issuer
+type RevokedSigningCertError struct {
+	KeyId  string
+	Serial string
+}
+
+func (err *RevokedSigningCertError) Error() string {
+	return fmt.Sprintf("The certificate with serial %v of the zts key with id:\"%v\" is revoked", err.Serial, err.KeyId)
+}
+
+// revocationCache remembers the revocation status of the signing certificates
+// checked by the runs of a configuration for the SigningCertRevocationTTL
+type revocationCache struct {
+	mutex   sync.Mutex
+	entries map[string]revocationStatus
+}
+
+type revocationStatus struct {
+	revoked bool
+	checked time.Time
+}
+
+func (config *ZpuConfiguration) revocationCache() *revocationCache {
+	config.initSharedState()
+	return config.revocations
+}
+
+func (config *ZpuConfiguration) signingCertRevocationTTL() time.Duration {
+	if config.SigningCertRevocationTTL > 0 {
+		return config.SigningCertRevocationTTL
+	}
+	return DEFAULT_SIGNING_CERT_REVOCATION_TTL
+}
+
+// checkSigningCertRevocation fails when the certificate configured for the
+// zts key id in ZtsSigningCerts is revoked. Keys without a certificate are
+// not checked, a certificate whose revocation cannot be checked fails the
+// validation. Only successful checks are cached.
+func checkSigningCertRevocation(config *ZpuConfiguration, keyId string) error {
+	certPEM, ok := config.ZtsSigningCerts[keyId]
+	if !ok {
+		return nil
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return fmt.Errorf("Unable to parse the certificate of the zts key with id:\"%v\", Error:%v", keyId, err)
+	}
+	serial := cert.SerialNumber.String()
+	cache := config.revocationCache()
+	now := config.GetClock().Now()
+	name := keyId + "/" + serial
+	cache.mutex.Lock()
+	status, ok := cache.entries[name]
+	cache.mutex.Unlock()
+	fresh := ok && now.Sub(status.checked) < config.signingCertRevocationTTL()
+	counters := config.cacheCounters()
+	countLookup(fresh, &counters.RevocationHits, &counters.RevocationMisses)
+	if !fresh {
+		revoked, err := isCertRevoked(config, cert)
+		if err != nil {
+			return fmt.Errorf("Unable to check the revocation of the certificate of the zts key with id:\"%v\", Error:%v", keyId, err)
+		}
+		status = revocationStatus{revoked: revoked, checked: now}
+		cache.mutex.Lock()
+		cache.entries[name] = status
+		cache.mutex.Unlock()
+	}
+	if status.revoked {
+		return &RevokedSigningCertError{KeyId: keyId, Serial: serial}
+	}
+	return nil
+}
+
+// isCertRevoked looks the certificate up on the CRL of its first
+// distribution point. The CRL must be issued by the issuer of the
+// certificate, signed by the SigningCertIssuer and not past its NextUpdate.
+// Without a SigningCertIssuer the CRL cannot be trusted and the check fails.
+// OCSP is not supported, certificates without a CRL distribution point fail.
+func isCertRevoked(config *ZpuConfiguration, cert *x509.Certificate) (bool, error) {
+	if config.SigningCertIssuer == "" {
+		return false, fmt.Errorf("No SigningCertIssuer configured to verify the CRL signature")
+	}
+	issuer, err := parseCertificate(config.SigningCertIssuer)
+	if err != nil {
+		return false, fmt.Errorf("Unable to parse the SigningCertIssuer, Error:%v", err)
+	}
+	if len(cert.CRLDistributionPoints) == 0 {
+		return false, fmt.Errorf("The certificate has no CRL distribution point")
+	}
+	url := cert.CRLDistributionPoints[0]
+	client := &http.Client{Timeout: SIGNING_CERT_CRL_TIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Fetching CRL %v returned status %v", url, resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+		return false, fmt.Errorf("The CRL %v is not issued by the issuer of the certificate", url)
+	}
+	err = crl.CheckSignatureFrom(issuer)
+	if err != nil {
+		return false, fmt.Errorf("The CRL %v is not signed by the SigningCertIssuer, Error:%v", url, err)
+	}
+	if crl.NextUpdate.IsZero() || config.GetClock().Now().After(crl.NextUpdate) {
+		return false, fmt.Errorf("The CRL %v is expired, its next update was due at %v", url, crl.NextUpdate)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func parseCertificate(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
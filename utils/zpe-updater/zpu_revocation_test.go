@@ -0,0 +1,212 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+)
+
+// crlResponder serves a CRL of the test CA listing the revoked serials,
+// valid for the validity and with a broken signature when tampered
+type crlResponder struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests int
+	revoked  []int64
+	validity time.Duration
+	tampered bool
+}
+
+func startCrlResponder(ca *x509.Certificate, caKey *ecdsa.PrivateKey) *crlResponder {
+	responder := &crlResponder{validity: 2 * time.Hour}
+	responder.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		responder.mutex.Lock()
+		responder.requests++
+		entries := []x509.RevocationListEntry{}
+		for _, serial := range responder.revoked {
+			entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now()})
+		}
+		validity, tampered := responder.validity, responder.tampered
+		responder.mutex.Unlock()
+		crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+			Number:                    big.NewInt(1),
+			ThisUpdate:                time.Now().Add(-2 * time.Hour),
+			NextUpdate:                time.Now().Add(validity),
+			RevokedCertificateEntries: entries,
+		}, ca, caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if tampered {
+			crl[len(crl)-1] ^= 0xff
+		}
+		w.Write(crl)
+	}))
+	return responder
+}
+
+func (responder *crlResponder) revoke(serial int64) {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	responder.revoked = append(responder.revoked, serial)
+}
+
+func (responder *crlResponder) serve(validity time.Duration, tampered bool) {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	responder.validity = validity
+	responder.tampered = tampered
+}
+
+func (responder *crlResponder) requestCount() int {
+	responder.mutex.Lock()
+	defer responder.mutex.Unlock()
+	return responder.requests
+}
+
+func createTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	return cert, key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func createSigningCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serial int64, crlURL string) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "sys.auth.zts"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		CRLDistributionPoints: []string{crlURL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	require.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestCheckSigningCertRevocation(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	ca, caKey, caPEM := createTestCA(t, "Test CA")
+	responder := startCrlResponder(ca, caKey)
+	defer responder.Close()
+
+	now := time.Now()
+	clock := newFakeClock(now)
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.Clock = clock
+	config.CheckSigningCertRevocation = true
+	config.SigningCertIssuer = caPEM
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 100, responder.URL)}
+
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "A certificate missing from the CRL is accepted")
+	a.Equal(1, responder.requestCount())
+
+	responder.revoke(100)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "The cached status is used within the TTL")
+	a.Equal(1, responder.requestCount())
+
+	clock.Advance(DEFAULT_SIGNING_CERT_REVOCATION_TTL)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.IsType(&RevokedSigningCertError{}, err)
+	a.Equal(2, responder.requestCount())
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.IsType(&RevokedSigningCertError{}, err, "The revoked status is cached")
+	a.Equal(2, responder.requestCount())
+
+	config.CheckSigningCertRevocation = false
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "The revocation is not checked unless configured")
+}
+
+func TestCheckSigningCertRevocationFailures(t *testing.T) {
+	a := assert.New(t)
+	zmsClient := zms.NewClient((*testConfig).Zms, nil)
+	ca, caKey, caPEM := createTestCA(t, "Test CA")
+	responder := startCrlResponder(ca, caKey)
+	defer responder.Close()
+	otherCA, otherKey, _ := createTestCA(t, "Other CA")
+	otherResponder := startCrlResponder(otherCA, otherKey)
+	defer otherResponder.Close()
+
+	now := time.Now()
+	data, err := signPolicyData(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.CheckSigningCertRevocation = true
+
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 104, responder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "A CRL cannot be trusted without a SigningCertIssuer")
+	a.Equal(0, responder.requestCount())
+
+	config.SigningCertIssuer = caPEM
+	config.ZtsSigningCerts = map[string]string{"1": createSigningCert(t, ca, caKey, 100, responder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err, "A key without a certificate is not checked")
+
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 101, otherResponder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "A CRL of another issuer is rejected")
+
+	_, _, config.SigningCertIssuer = createTestCA(t, "Test CA")
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 102, responder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "A CRL not signed by the SigningCertIssuer is rejected")
+
+	config.SigningCertIssuer = caPEM
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 103, "http://127.0.0.1:1/crl")}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "An unreachable CRL fails the validation")
+
+	responder.serve(2*time.Hour, true)
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 105, responder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "A CRL with a broken signature is rejected")
+	a.Contains(err.Error(), "not signed by the SigningCertIssuer")
+
+	responder.serve(-time.Minute, false)
+	config.ZtsSigningCerts = map[string]string{"0": createSigningCert(t, ca, caKey, 106, responder.URL)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.NotNil(err, "A CRL past its next update is rejected")
+	a.Contains(err.Error(), "is expired")
+
+	responder.serve(2*time.Hour, false)
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	a.Nil(err)
+}
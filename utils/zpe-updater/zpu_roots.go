@@ -0,0 +1,65 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"fmt"
+)
+
+// UntrustedSignatureError is returned when a signature of the policy data
+// verifies with none of the TrustedRootKeys
+type UntrustedSignatureError struct {
+	Service string
+	Roots   int
+}
+
+func (e *UntrustedSignatureError) Error() string {
+	return fmt.Sprintf("The %v signature does not verify with any of the %v trusted root keys", e.Service, e.Roots)
+}
+
+// signerPublicKeys returns the public keys a signature of the zts or zms
+// service may verify with: the TrustedRootKeys when set, without looking
+// at the key id, otherwise the configured or fetched key of the key id
+func signerPublicKeys(config *ZpuConfiguration, getPublicKey publicKeyGetter, service, keyId string) ([]string, error) {
+	if len(config.TrustedRootKeys) > 0 {
+		return config.TrustedRootKeys, nil
+	}
+	var publicKey string
+	if service == "zts" {
+		publicKey = config.GetZtsPublicKey(keyId)
+	} else {
+		publicKey = config.GetZmsPublicKey(keyId)
+	}
+	if publicKey != "" {
+		return []string{publicKey}, nil
+	}
+	publicKey, err := getPublicKey(service, keyId)
+	if err != nil {
+		return nil, err
+	}
+	return []string{publicKey}, nil
+}
+
+// verifyWithAnyKey verifies the signature with the public keys returned by
+// signerPublicKeys and returns the key it verified with. The key of a key id
+// returns its verification error, the TrustedRootKeys are tried until one
+// succeeds and return an UntrustedSignatureError unless a verification timed
+// out.
+func verifyWithAnyKey(config *ZpuConfiguration, service, input, signature string, publicKeys []string) (string, error) {
+	if len(config.TrustedRootKeys) == 0 {
+		return publicKeys[0], verifyWithTimeout(config, input, signature, publicKeys[0])
+	}
+	for _, publicKey := range publicKeys {
+		err := verifyWithTimeout(config, input, signature, publicKey)
+		if err == nil {
+			return publicKey, nil
+		}
+		var timeoutErr *VerifyTimeoutError
+		if errors.As(err, &timeoutErr) {
+			return "", err
+		}
+	}
+	return "", &UntrustedSignatureError{Service: service, Roots: len(publicKeys)}
+}
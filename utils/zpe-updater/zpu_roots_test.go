@@ -0,0 +1,88 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func generatePublicKey(t *testing.T) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.Nil(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.Nil(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+func TestTrustedRootKeys(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := testPolicySigner("zts.unknown", "zms.unknown").Sign(DOMAIN, now, now.Add(time.Hour))
+	require.Nil(t, err)
+
+	//no key maps and no zms
+	config := &ZpuConfiguration{TrustedRootKeys: []string{generatePublicKey(t), testPublicKey, generatePublicKey(t)}}
+	zmsClient := zms.NewClient("http://127.0.0.1:1/zms/v1", nil)
+	a.Nil(ValidateSignedPolicies(config, zmsClient, data), "The signatures verify with one of the trusted roots")
+	lookups := 0
+	a.Nil(validateSignedPolicies(config, func(service, keyId string) (string, error) {
+		lookups++
+		return "", errors.New("Unexpected public key lookup")
+	}, data))
+	a.Equal(0, lookups, "The key ids are not looked up")
+
+	config.TrustedRootKeys = []string{generatePublicKey(t), generatePublicKey(t)}
+	err = ValidateSignedPolicies(config, zmsClient, data)
+	var untrustedErr *UntrustedSignatureError
+	require.True(t, errors.As(err, &untrustedErr))
+	a.Equal("zts", untrustedErr.Service)
+	a.Equal(2, untrustedErr.Roots)
+}
+
+func TestTrustedRootKeysAlgorithmDowngrade(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := testPolicySigner("zts.unknown", "zms.unknown").Sign("rootsalg", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"rootsalg": data})
+	defer server.Close()
+	var zmsRequests int32
+	zmsServer := startFailingServer(http.StatusInternalServerError, 0, &zmsRequests)
+	defer zmsServer.Close()
+	defer removePolicyFiles("rootsalg")
+	sidecar := algorithmFile(POLICIES_DIR + "/rootsalg.pol")
+	defer os.Remove(sidecar)
+	removePolicyFiles("rootsalg")
+	os.Remove(sidecar)
+
+	//every zms call fails, the algorithms come from the root that verified
+	config := getServerConfiguration(server, "rootsalg")
+	config.Zms = zmsServer.URL
+	config.ZtsKeysmap = map[string]string{}
+	config.ZmsKeysmap = map[string]string{}
+	config.TrustedRootKeys = []string{generatePublicKey(t), testPublicKey}
+	config.DetectAlgorithmDowngrade = true
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"rootsalg"}, result.UpdatedDomains)
+	a.Equal(int32(0), atomic.LoadInt32(&zmsRequests), "No public key is looked up in zms")
+	recorded, err := ioutil.ReadFile(sidecar)
+	a.Nil(err)
+	a.Equal(`{"zms":"RSA-2048-SHA256","zts":"RSA-2048-SHA256"}`, string(recorded))
+}
@@ -0,0 +1,74 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MisroutedDomainError is returned when the signed policy data of a domain
+// is served by another endpoint than the one of its zts shard
+type MisroutedDomainError struct {
+	Domain   string
+	Expected string
+	Served   string
+}
+
+func (e *MisroutedDomainError) Error() string {
+	return fmt.Sprintf("Policies for domain: %v served by %v instead of the expected zts shard %v", e.Domain, e.Served, e.Expected)
+}
+
+// shardTransport checks that the endpoint serving the signed policy data of
+// a domain, after any redirect, is the one returned by the resolver
+type shardTransport struct {
+	base     http.RoundTripper
+	resolver func(domain string) string
+}
+
+func (transport *shardTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := transport.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	domain := signedPolicyDataDomain(req.URL.Path)
+	if domain == "" {
+		return resp, nil
+	}
+	expected := transport.resolver(domain)
+	if expected == "" || sameEndpoint(expected, req.URL) {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return nil, &MisroutedDomainError{Domain: domain, Expected: expected, Served: req.URL.Scheme + "://" + req.URL.Host}
+}
+
+// signedPolicyDataDomain returns the domain of a signed policy data request
+// path, "" for other requests
+func signedPolicyDataDomain(path string) string {
+	if !strings.HasSuffix(path, "/signed_policy_data") {
+		return ""
+	}
+	path = strings.TrimSuffix(path, "/signed_policy_data")
+	i := strings.LastIndex(path, "/domain/")
+	if i < 0 {
+		return ""
+	}
+	return path[i+len("/domain/"):]
+}
+
+// sameEndpoint reports whether the request went to the expected endpoint,
+// the scheme is only compared when the expected endpoint has one
+func sameEndpoint(expected string, served *url.URL) bool {
+	endpoint, err := url.Parse(expected)
+	if err != nil || endpoint.Host == "" {
+		return strings.EqualFold(expected, served.Host)
+	}
+	if endpoint.Scheme != "" && !strings.EqualFold(endpoint.Scheme, served.Scheme) {
+		return false
+	}
+	return strings.EqualFold(endpoint.Host, served.Host)
+}
@@ -0,0 +1,71 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestDomainShardResolver(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("sharded", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	shard := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"sharded": data})
+	defer shard.Close()
+	//the front end redirects every request to the shard
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, shard.URL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer front.Close()
+	shardUrl, err := url.Parse(shard.URL)
+	require.Nil(t, err)
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, DomainShardResolver: func(domain string) string {
+		return shard.URL
+	}}
+	client := zts.NewClient(formatUrl(front.URL, "zts/v1"), newClientTransport(config))
+	_, _, err = fetchSignedPolicyData(config, client, "sharded", "")
+	a.Nil(err, "The redirect to the expected shard is followed")
+
+	config.DomainShardResolver = func(domain string) string {
+		return shardUrl.Host
+	}
+	_, _, err = fetchSignedPolicyData(config, client, "sharded", "")
+	a.Nil(err)
+
+	config.DomainShardResolver = func(domain string) string {
+		return front.URL
+	}
+	client = zts.NewClient(formatUrl(front.URL, "zts/v1"), newClientTransport(config))
+	_, _, err = fetchSignedPolicyData(config, client, "sharded", "")
+	var misrouted *MisroutedDomainError
+	a.True(errors.As(err, &misrouted))
+	a.Equal("sharded", misrouted.Domain)
+	a.Equal(front.URL, misrouted.Expected)
+	a.Equal(shard.URL, misrouted.Served)
+
+	config.DomainShardResolver = func(domain string) string {
+		return ""
+	}
+	client = zts.NewClient(formatUrl(front.URL, "zts/v1"), newClientTransport(config))
+	_, _, err = fetchSignedPolicyData(config, client, "sharded", "")
+	a.Nil(err, "Domains without a shard accept any endpoint")
+}
+
+func TestSignedPolicyDataDomain(t *testing.T) {
+	a := assert.New(t)
+	a.Equal("sports", signedPolicyDataDomain("/zts/v1/domain/sports/signed_policy_data"))
+	a.Equal("", signedPolicyDataDomain("/zts/v1/domain/sports/metrics"))
+	a.Equal("", signedPolicyDataDomain("/signed_policy_data"))
+}
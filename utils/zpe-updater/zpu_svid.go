@@ -0,0 +1,29 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// svidTransport authenticates every request with a bearer JWT-SVID fetched
+// from the provider, so a rotated token is picked up by the next request
+type svidTransport struct {
+	base     http.RoundTripper
+	provider func() (string, error)
+}
+
+func (transport *svidTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := transport.provider()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get the SVID token for request to %v, Error:%v", req.URL.Host, err)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("Empty SVID token for request to %v", req.URL.Host)
+	}
+	authReq := req.Clone(req.Context())
+	authReq.Header.Set("Authorization", "Bearer "+token)
+	return transport.base.RoundTrip(authReq)
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestSVIDProviderRefreshedPerRequest(t *testing.T) {
+	a := assert.New(t)
+	var mutex sync.Mutex
+	headers := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		headers = append(headers, r.Header.Get("Authorization"))
+		mutex.Unlock()
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	issued := 0
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, SVIDProvider: func() (string, error) {
+		issued++
+		return "svid-" + strconv.Itoa(issued), nil
+	}}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(config))
+	ztsClient.GetDomainSignedPolicyData("svid", "")
+	ztsClient.GetDomainSignedPolicyData("svid", "")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	a.Equal([]string{"Bearer svid-1", "Bearer svid-2"}, headers)
+}
+
+func TestSVIDProviderError(t *testing.T) {
+	a := assert.New(t)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	config := &ZpuConfiguration{AllowInsecureHTTP: true, SVIDProvider: func() (string, error) {
+		return "", errors.New("workload api unavailable")
+	}}
+	ztsClient := zts.NewClient(formatUrl(server.URL, "zts/v1"), newClientTransport(config))
+	_, _, err := ztsClient.GetDomainSignedPolicyData("svid", "")
+	a.NotNil(err)
+	a.Equal(0, requests, "No request is sent without a token")
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sameDir reports whether both paths name the same directory
+func sameDir(dir1, dir2 string) bool {
+	if filepath.Clean(dir1) == filepath.Clean(dir2) {
+		return true
+	}
+	info1, err := os.Stat(dir1)
+	if err != nil {
+		return false
+	}
+	info2, err := os.Stat(dir2)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(info1, info2)
+}
+
+// sweepTempFiles removes the temporary policy files left behind by an
+// interrupted run. Only files with the .tmp extension are removed so the
+// sweep is safe when the temporary directory is also the policy directory.
+func sweepTempFiles(config *ZpuConfiguration, policyFileDir string) {
+	tmpDir := config.tmpPolicyDir()
+	if sameDir(tmpDir, policyFileDir) {
+		log.Printf("Warning: temporary policy directory: %v is the policy directory, only .tmp files are swept", tmpDir)
+	}
+	files, err := ioutil.ReadDir(tmpDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Unable to read temporary policy directory: %v for sweep, Error:%v", tmpDir, err)
+		}
+		return
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		err := os.Remove(filepath.Join(tmpDir, f.Name()))
+		if err != nil {
+			log.Printf("Unable to remove temporary policy file: %v, Error:%v", f.Name(), err)
+			continue
+		}
+		log.Printf("Removed temporary policy file: %v left by a previous run", f.Name())
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestSweepTempFilesSameDir(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/sweep"
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	data, err := signPolicyData("sweep1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"sweep1": data})
+	defer server.Close()
+	require.Nil(t, ioutil.WriteFile(dir+"/stored.pol", []byte("{}"), 0644))
+	require.Nil(t, ioutil.WriteFile(dir+"/orphan.tmp", []byte("{}"), 0644))
+	require.Nil(t, ioutil.WriteFile(dir+"/notes.txt", []byte(""), 0644))
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	config := getServerConfiguration(server, "sweep1")
+	config.PolicyFileDir = dir
+	config.TmpPolicyFileDir = dir + "/"
+	config.SweepTempFiles = true
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.True(strings.Contains(logs.String(), "is the policy directory"))
+	a.Equal(util.Exists(dir+"/orphan.tmp"), false)
+	a.Equal(util.Exists(dir+"/stored.pol"), true, "Policy files are never swept")
+	a.Equal(util.Exists(dir+"/sweep1.pol"), true)
+	a.Equal(util.Exists(dir+"/notes.txt"), true)
+}
+
+func TestSweepTempFiles(t *testing.T) {
+	a := assert.New(t)
+	require.Nil(t, os.MkdirAll(TEMP_POLICIES_DIR, 0755))
+	require.Nil(t, ioutil.WriteFile(TEMP_POLICIES_DIR+"/orphan.tmp", []byte("{}"), 0644))
+	config := getSigningConfiguration()
+	sweepTempFiles(config, POLICIES_DIR)
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/orphan.tmp"), false)
+	a.False(sameDir(TEMP_POLICIES_DIR, POLICIES_DIR))
+}
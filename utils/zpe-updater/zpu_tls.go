@@ -0,0 +1,93 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+)
+
+// WeakServerKeyError is returned from the tls handshake when the server
+// certificate key is weaker than an rsa key of the configured
+// MinServerKeyBits. Bits is the size of the server key itself and
+// RsaBits the size of an rsa key of the same strength.
+type WeakServerKeyError struct {
+	Subject string
+	Bits    int
+	RsaBits int
+	MinBits int
+}
+
+func (e *WeakServerKeyError) Error() string {
+	return fmt.Sprintf("Server certificate: %v has a %v bit key, as strong as a %v bit rsa key, at least %v rsa bits are required", e.Subject, e.Bits, e.RsaBits, e.MinBits)
+}
+
+// newMinKeyBitsTransport returns a transport whose tls handshakes fail for
+// servers with a certificate key weaker than an rsa key of minBits
+func newMinKeyBitsTransport(minBits int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{
+		VerifyConnection: func(state tls.ConnectionState) error {
+			return verifyServerKeyBits(state, minBits)
+		},
+	}
+	return transport
+}
+
+// verifyServerKeyBits rejects the connection when the leaf certificate of
+// the server has a key weaker than an rsa key of minBits
+func verifyServerKeyBits(state tls.ConnectionState, minBits int) error {
+	if len(state.PeerCertificates) == 0 {
+		return fmt.Errorf("No server certificate to verify the key size")
+	}
+	leaf := state.PeerCertificates[0]
+	bits, rsaBits, err := publicKeyBits(leaf)
+	if err != nil {
+		return err
+	}
+	if rsaBits < minBits {
+		return &WeakServerKeyError{Subject: leaf.Subject.String(), Bits: bits, RsaBits: rsaBits, MinBits: minBits}
+	}
+	return nil
+}
+
+// publicKeyBits returns the size of the certificate key and the size of an
+// rsa key of the same strength, following the comparable strengths of
+// NIST SP 800-57 part 1: a 256 bit curve is as strong as a 3072 bit rsa key
+func publicKeyBits(cert *x509.Certificate) (int, int, error) {
+	switch key := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		bits := key.N.BitLen()
+		return bits, bits, nil
+	case *ecdsa.PublicKey:
+		bits := key.Curve.Params().BitSize
+		return bits, curveRsaBits(bits), nil
+	case ed25519.PublicKey:
+		return 256, curveRsaBits(256), nil
+	default:
+		return 0, 0, fmt.Errorf("Unsupported server certificate key type: %T", cert.PublicKey)
+	}
+}
+
+// curveRsaBits maps the size of an elliptic curve key to the size of an rsa
+// key of the same security strength
+func curveRsaBits(bits int) int {
+	switch {
+	case bits >= 512:
+		return 15360
+	case bits >= 384:
+		return 7680
+	case bits >= 256:
+		return 3072
+	case bits >= 224:
+		return 2048
+	default:
+		return 1024
+	}
+}
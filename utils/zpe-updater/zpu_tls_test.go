@@ -0,0 +1,117 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTLSServer starts a tls server with a self signed certificate using an
+// rsa key of the given size and returns it with a pool trusting the certificate
+func startTLSServer(t *testing.T, bits int) (*httptest.Server, *x509.CertPool) {
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	require.Nil(t, err)
+	return startTLSServerWithKey(t, key)
+}
+
+func startTLSServerWithKey(t *testing.T, key crypto.Signer) (*httptest.Server, *x509.CertPool) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "zts.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.Nil(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	server.StartTLS()
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return server, pool
+}
+
+func getTestTransport(config *ZpuConfiguration, pool *x509.CertPool) *http.Transport {
+	transport := newMinKeyBitsTransport(config.MinServerKeyBits)
+	transport.TLSClientConfig.RootCAs = pool
+	return transport
+}
+
+func TestMinServerKeyBitsRefusesWeakKey(t *testing.T) {
+	a := assert.New(t)
+	server, pool := startTLSServer(t, 1024)
+	defer server.Close()
+
+	config := &ZpuConfiguration{MinServerKeyBits: 2048}
+	client := &http.Client{Transport: getTestTransport(config, pool)}
+	_, err := client.Get(server.URL)
+	a.NotNil(err)
+	a.True(strings.Contains(err.Error(), "1024 bit key"))
+}
+
+func TestMinServerKeyBitsComparesEcKeyStrength(t *testing.T) {
+	a := assert.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	server, pool := startTLSServerWithKey(t, key)
+	defer server.Close()
+
+	config := &ZpuConfiguration{MinServerKeyBits: 2048}
+	client := &http.Client{Transport: getTestTransport(config, pool)}
+	resp, err := client.Get(server.URL)
+	a.Nil(err, "A P-256 key is as strong as a 3072 bit rsa key")
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	config = &ZpuConfiguration{MinServerKeyBits: 4096}
+	client = &http.Client{Transport: getTestTransport(config, pool)}
+	_, err = client.Get(server.URL)
+	a.NotNil(err)
+	a.True(strings.Contains(err.Error(), "256 bit key, as strong as a 3072 bit rsa key"))
+}
+
+func TestMinServerKeyBitsAllowsStrongKey(t *testing.T) {
+	a := assert.New(t)
+	server, pool := startTLSServer(t, 2048)
+	defer server.Close()
+
+	config := &ZpuConfiguration{MinServerKeyBits: 2048}
+	client := &http.Client{Transport: getTestTransport(config, pool)}
+	resp, err := client.Get(server.URL)
+	a.Nil(err)
+	if resp != nil {
+		resp.Body.Close()
+	}
+}
+
+func TestMinServerKeyBitsDisabled(t *testing.T) {
+	a := assert.New(t)
+	transport := newClientTransport(&ZpuConfiguration{}).(*contentTypeTransport)
+	a.Equal(http.DefaultTransport, transport.base.(*insecureTransport).base)
+}
@@ -0,0 +1,72 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// PolicyModificationError is returned when the PostValidateTransform changes
+// the signed policy data without AllowPolicyModification.
+type PolicyModificationError struct {
+	Domain string
+}
+
+func (e *PolicyModificationError) Error() string {
+	return fmt.Sprintf("Post validation transform modified the signed policies of domain: %v, AllowPolicyModification is not set", e.Domain)
+}
+
+// applyPostValidateTransform runs the configured transform over the validated
+// policy data and reports whether it modified the data. A transform that
+// leaves the data unchanged does not count as a modification.
+func applyPostValidateTransform(config *ZpuConfiguration, data *zts.DomainSignedPolicyData, domain string) (bool, error) {
+	if config.PostValidateTransform == nil {
+		return false, nil
+	}
+	before, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	err = config.PostValidateTransform(data)
+	if err != nil {
+		return false, fmt.Errorf("Post validation transform failed for domain: %v, Error:%v", domain, err)
+	}
+	after, err := json.Marshal(data)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(before, after) {
+		return false, nil
+	}
+	if !config.AllowPolicyModification {
+		return false, &PolicyModificationError{Domain: domain}
+	}
+	return true, nil
+}
+
+// modifiedMarkerFile flags a policy file whose signatures no longer verify
+// because the PostValidateTransform modified it
+func modifiedMarkerFile(policyFile string) string {
+	return policyFile + ".modified"
+}
+
+// updateModifiedMarker creates or removes the modified marker of the policy
+// file once the policy file is written
+func updateModifiedMarker(policyFile string, modified bool) error {
+	markerFile := modifiedMarkerFile(policyFile)
+	if modified {
+		return ioutil.WriteFile(markerFile, []byte{}, 0644)
+	}
+	if util.Exists(markerFile) {
+		return os.Remove(markerFile)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func annotatePolicies(data *zts.DomainSignedPolicyData) error {
+	for _, policy := range data.SignedPolicyData.PolicyData.Policies {
+		policy.Name = policy.Name + "-annotated"
+	}
+	return nil
+}
+
+func TestPostValidateTransformModification(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("transform1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"transform1": data})
+	defer server.Close()
+	defer removePolicyFiles("transform1")
+	policyFile := POLICIES_DIR + "/transform1.pol"
+	defer os.Remove(modifiedMarkerFile(policyFile))
+
+	config := getServerConfiguration(server, "transform1")
+	config.PostValidateTransform = annotatePolicies
+	result, err := UpdatePolicies(config)
+	a.NotNil(err)
+	a.Equal([]string{"transform1"}, result.FailedDomains, "Modifications require AllowPolicyModification")
+	a.Equal(util.Exists(policyFile), false)
+
+	// the rejected transform already changed the served data in place
+	data, err = signPolicyData("transform1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server.SetPolicies("transform1", data)
+	config.AllowPolicyModification = true
+	result, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal([]string{"transform1"}, result.UpdatedDomains)
+	a.Equal([]string{"transform1"}, result.ModifiedDomains)
+	a.Equal(util.Exists(modifiedMarkerFile(policyFile)), true)
+	stored, err := readPolicyFile(config, policyFile)
+	a.Nil(err)
+	a.Equal("transform1:policy.admin-annotated", string(stored.SignedPolicyData.PolicyData.Policies[0].Name))
+
+	plan := planDomain(config, "transform1", POLICIES_DIR)
+	a.Equal(PLAN_FULL_FETCH, plan.Action, "Modified policies cannot be validated for an etag")
+}
+
+func TestPostValidateTransformFanOutMarker(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("transform3", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"transform3": data})
+	defer server.Close()
+	defer removePolicyFiles("transform3")
+	fanOutDir := POLICIES_DIR + "_transform_fanout"
+	require.Nil(t, os.MkdirAll(fanOutDir, 0755))
+	defer os.RemoveAll(fanOutDir)
+	defer os.Remove(modifiedMarkerFile(POLICIES_DIR + "/transform3.pol"))
+
+	config := getServerConfiguration(server, "transform3")
+	config.PolicyFileDirs = []string{fanOutDir}
+	config.PostValidateTransform = annotatePolicies
+	config.AllowPolicyModification = true
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal(util.Exists(modifiedMarkerFile(POLICIES_DIR+"/transform3.pol")), true)
+	a.Equal(util.Exists(modifiedMarkerFile(fanOutDir+"/transform3.pol")), true, "Every copy of the policy file is flagged")
+
+	config.PostValidateTransform = nil
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal(util.Exists(modifiedMarkerFile(fanOutDir+"/transform3.pol")), false)
+}
+
+func TestPostValidateTransformNoop(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("transform2", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"transform2": data})
+	defer server.Close()
+	defer removePolicyFiles("transform2")
+
+	calls := 0
+	config := getServerConfiguration(server, "transform2")
+	config.PostValidateTransform = func(data *zts.DomainSignedPolicyData) error {
+		calls++
+		return nil
+	}
+	result, err := UpdatePolicies(config)
+	a.Nil(err)
+	a.Equal(1, calls)
+	a.Equal([]string{"transform2"}, result.UpdatedDomains)
+	a.Equal(0, len(result.ModifiedDomains))
+	a.Equal(util.Exists(modifiedMarkerFile(POLICIES_DIR+"/transform2.pol")), false)
+}
@@ -0,0 +1,65 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/yahoo/athenz/clients/go/zms"
+)
+
+// ValidatePolicyDir validates every policy file in the policy directory and
+// returns the validation error of each domain, nil for valid policies. The
+// files are validated by ValidateConcurrency workers sharing the public keys
+// fetched from zms.
+func ValidatePolicyDir(config *ZpuConfiguration, zmsClient zms.ZMSClient) (map[string]error, error) {
+	policyFileDir := config.policyDir()
+	files, err := ioutil.ReadDir(policyFileDir)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read policy directory: %v, Error:%v", policyFileDir, err)
+	}
+	config.initSharedState()
+	workers := config.ValidateConcurrency
+	if workers <= 0 {
+		workers = DEFAULT_VALIDATE_CONCURRENCY
+	}
+	keys := newPublicKeyCache(config, zmsClient)
+	domains := make(chan string)
+	results := make(map[string]error)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domain := range domains {
+				err := validatePolicyFile(config, keys.get, policyFileDir, domain)
+				mutex.Lock()
+				results[domain] = err
+				mutex.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), config.policyFileExt()) {
+			continue
+		}
+		domains <- strings.TrimSuffix(f.Name(), config.policyFileExt())
+	}
+	close(domains)
+	wg.Wait()
+	return results, nil
+}
+
+func validatePolicyFile(config *ZpuConfiguration, getPublicKey publicKeyGetter, policyFileDir, domain string) error {
+	policyFile := config.policyFile(policyFileDir, domain)
+	data, err := readPolicyFile(config, policyFile)
+	if err != nil {
+		return err
+	}
+	return validateSignedPolicies(config, getPublicKey, data)
+}
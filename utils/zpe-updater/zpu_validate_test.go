@@ -0,0 +1,193 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/libs/go/zmssvctoken"
+)
+
+// trackedFile records the number of policy files open at once
+type trackedFile struct {
+	io.ReadCloser
+	tracker *openFileTracker
+}
+
+type openFileTracker struct {
+	mutex sync.Mutex
+	open  int
+	peak  int
+}
+
+func (tracker *openFileTracker) openFile(policyFile string) (io.ReadCloser, error) {
+	file, err := os.Open(policyFile)
+	if err != nil {
+		return nil, err
+	}
+	tracker.mutex.Lock()
+	tracker.open++
+	if tracker.open > tracker.peak {
+		tracker.peak = tracker.open
+	}
+	tracker.mutex.Unlock()
+	time.Sleep(time.Millisecond)
+	return &trackedFile{file, tracker}, nil
+}
+
+func (file *trackedFile) Close() error {
+	file.tracker.mutex.Lock()
+	file.tracker.open--
+	file.tracker.mutex.Unlock()
+	return file.ReadCloser.Close()
+}
+
+func createPolicyDir(t *testing.T, dir string, count int) []string {
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	now := time.Now()
+	domains := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		domain := fmt.Sprintf("validate%d", i)
+		data, err := signPolicyData(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(testConfig, data, domain, dir))
+		domains = append(domains, domain)
+	}
+	return domains
+}
+
+func TestValidatePolicyDirMaxOpenFiles(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/validate"
+	defer os.RemoveAll(dir)
+	domains := createPolicyDir(t, dir, 100)
+	//an invalid policy file and a non policy file
+	require.Nil(t, ioutil.WriteFile(dir+"/invalid.pol", []byte("{"), 0644))
+	require.Nil(t, ioutil.WriteFile(dir+"/ignored.txt", []byte("{"), 0644))
+
+	tracker := &openFileTracker{}
+	defer func(open func(string) (io.ReadCloser, error)) { openPolicyFile = open }(openPolicyFile)
+	openPolicyFile = tracker.openFile
+
+	config := getSigningConfiguration()
+	config.PolicyFileDir = dir
+	config.MaxOpenFiles = 4
+	results, err := ValidatePolicyDir(config, zmsClientForTest())
+	a.Nil(err)
+	a.Equal(len(domains)+1, len(results))
+	for _, domain := range domains {
+		a.Nil(results[domain], "Policies for "+domain+" should be valid")
+	}
+	a.NotNil(results["invalid"])
+	a.True(tracker.peak <= 4, "At most 4 policy files should be open at once")
+	a.True(tracker.peak > 0)
+}
+
+func TestValidatePolicyDirSharedKeyCache(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/validate_keys"
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{}
+	domains := []string{}
+	for i := 0; i < 50; i++ {
+		domain := fmt.Sprintf("shared%d", i)
+		data, err := testPolicySigner("0", "zms.shared").Sign(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(config, data, domain, dir))
+		domains = append(domains, domain)
+	}
+	expired, err := testPolicySigner("0", "zms.shared").Sign("expired", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	require.Nil(t, err)
+	require.Nil(t, WritePolicies(config, expired, "expired", dir))
+
+	var fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/zms/v1/domain/sys.auth/service/zms/publickey/zms.shared" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: "zms.shared", Key: new(zmssvctoken.YBase64).EncodeToString([]byte(testPublicKey))})
+	}))
+	defer server.Close()
+
+	config.PolicyFileDir = dir
+	config.ValidateConcurrency = 4
+	results, err := ValidatePolicyDir(config, zms.NewClient(formatUrl(server.URL, "zms/v1"), nil))
+	a.Nil(err)
+	a.Equal(len(domains)+1, len(results))
+	for _, domain := range domains {
+		a.Nil(results[domain], "Policies for "+domain+" should be valid")
+	}
+	a.NotNil(results["expired"])
+	a.Equal(int32(1), atomic.LoadInt32(&fetches), "The shared zms key is fetched once")
+}
+
+func TestValidatePolicyDirMaxConcurrentKeyFetches(t *testing.T) {
+	a := assert.New(t)
+	dir := POLICIES_DIR + "/validate_key_fetches"
+	require.Nil(t, os.MkdirAll(dir, 0755))
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	config := getSigningConfiguration()
+	config.ZmsKeysmap = map[string]string{}
+	domains := []string{}
+	for i := 0; i < 20; i++ {
+		domain := fmt.Sprintf("keyfetch%d", i)
+		data, err := testPolicySigner("0", fmt.Sprintf("zms.key%d", i)).Sign(domain, now, now.Add(time.Hour))
+		require.Nil(t, err)
+		require.Nil(t, WritePolicies(config, data, domain, dir))
+		domains = append(domains, domain)
+	}
+
+	var inFlight, peak, fetches int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			previous := atomic.LoadInt32(&peak)
+			if current <= previous || atomic.CompareAndSwapInt32(&peak, previous, current) {
+				break
+			}
+		}
+		atomic.AddInt32(&fetches, 1)
+		time.Sleep(10 * time.Millisecond)
+		keyId := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&zms.PublicKeyEntry{Id: keyId, Key: new(zmssvctoken.YBase64).EncodeToString([]byte(testPublicKey))})
+	}))
+	defer server.Close()
+
+	config.PolicyFileDir = dir
+	config.ValidateConcurrency = 8
+	config.MaxConcurrentKeyFetches = 2
+	results, err := ValidatePolicyDir(config, zms.NewClient(formatUrl(server.URL, "zms/v1"), nil))
+	a.Nil(err)
+	for _, domain := range domains {
+		a.Nil(results[domain], "Policies for "+domain+" should be valid")
+	}
+	a.Equal(int32(len(domains)), atomic.LoadInt32(&fetches), "Every distinct zms key is fetched")
+	a.True(atomic.LoadInt32(&peak) <= 2, "At most 2 zms keys should be fetched at once")
+	a.True(atomic.LoadInt32(&peak) > 0)
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/yahoo/athenz/clients/go/zms"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// policyFileWritten is called once a policy file is in place and before it
+// is read back, tests replace it to corrupt the written file
+var policyFileWritten = func(policyFile string) {}
+
+// writeVerifiedPolicies writes the policies like WritePolicies and then reads
+// back and validates the written file, restoring the previous policy file if
+// the written one does not validate
+func writeVerifiedPolicies(config *ZpuConfiguration, zmsClient zms.ZMSClient, data *zts.DomainSignedPolicyData, domain, policyFileDir string, modified bool) error {
+	policyFile := config.policyFile(policyFileDir, domain)
+	backupFile, err := backupPolicyFile(config, domain, policyFile)
+	if err != nil {
+		return err
+	}
+	err = WritePolicies(config, data, domain, policyFileDir)
+	if err != nil {
+		if backupFile != "" {
+			os.Remove(backupFile)
+		}
+		return err
+	}
+	return verifyWrittenPolicyFile(config, zmsClient, policyFile, backupFile, modified)
+}
+
+// backupPolicyFile copies the current policy file of the domain to the
+// temporary policy directory and returns the copy, or "" if the domain has
+// no policy file yet
+func backupPolicyFile(config *ZpuConfiguration, domain, policyFile string) (string, error) {
+	if !util.Exists(policyFile) {
+		return "", nil
+	}
+	bytes, err := ioutil.ReadFile(policyFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read policy file: %v for backup, Error:%v", policyFile, err)
+	}
+	err = verifyTmpDirSetup(config.tmpPolicyDir())
+	if err != nil {
+		return "", err
+	}
+	backupFile := fmt.Sprintf("%s/%s.bak", config.tmpPolicyDir(), domain)
+	err = ioutil.WriteFile(backupFile, bytes, 0755)
+	if err != nil {
+		return "", fmt.Errorf("Unable to write backup of policy file: %v, Error:%v", policyFile, err)
+	}
+	return backupFile, nil
+}
+
+// verifyWrittenPolicyFile reads back and validates the written policy file.
+// If it does not validate the backup is moved back into place, or the file
+// is removed when there was no previous policy file. The signatures of
+// modified policy data no longer verify so it is only decoded.
+func verifyWrittenPolicyFile(config *ZpuConfiguration, zmsClient zms.ZMSClient, policyFile, backupFile string, modified bool) error {
+	policyFileWritten(policyFile)
+	data, err := readPolicyFile(config, policyFile)
+	if err == nil && !modified {
+		err = ValidateSignedPolicies(config, zmsClient, data)
+	}
+	if err == nil {
+		if backupFile != "" {
+			os.Remove(backupFile)
+		}
+		return nil
+	}
+	if backupFile == "" {
+		os.Remove(policyFile)
+		return fmt.Errorf("Verification of written policy file: %v failed, file removed, Error:%v", policyFile, err)
+	}
+	restoreErr := commitPolicyFile(config, backupFile, policyFile)
+	if restoreErr != nil {
+		return fmt.Errorf("Verification of written policy file: %v failed, Error:%v, unable to restore backup: %v, Error:%v", policyFile, err, backupFile, restoreErr)
+	}
+	return fmt.Errorf("Verification of written policy file: %v failed, previous policy file restored, Error:%v", policyFile, err)
+}
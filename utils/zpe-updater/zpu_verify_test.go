@@ -0,0 +1,106 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// corruptWrittenPolicyFiles replaces policyFileWritten with a fault injector
+// that truncates every policy file once it is in place
+func corruptWrittenPolicyFiles() func() {
+	original := policyFileWritten
+	policyFileWritten = func(policyFile string) {
+		ioutil.WriteFile(policyFile, []byte(`{"signedPolicyData":`), 0755)
+	}
+	return func() {
+		policyFileWritten = original
+	}
+}
+
+func TestVerifyAfterWriteRestoresBackup(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	previous, err := signPolicyData("verify1", now.Add(-time.Minute), now.Add(time.Hour))
+	require.Nil(t, err)
+	data, err := signPolicyData("verify1", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.VerifyAfterWrite = true
+	defer removePolicyFiles("verify1")
+
+	require.Nil(t, WritePolicies(config, previous, "verify1", POLICIES_DIR))
+	policyFile := fmt.Sprintf("%s/verify1.pol", POLICIES_DIR)
+	stored, err := ioutil.ReadFile(policyFile)
+	require.Nil(t, err)
+
+	restore := corruptWrittenPolicyFiles()
+	err = writeVerifiedPolicies(config, zmsClientForTest(), data, "verify1", POLICIES_DIR, false)
+	restore()
+	a.NotNil(err)
+	restored, err := ioutil.ReadFile(policyFile)
+	a.Nil(err)
+	a.Equal(string(stored), string(restored), "The previous policy file must be restored")
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/verify1.bak"), false)
+
+	err = writeVerifiedPolicies(config, zmsClientForTest(), data, "verify1", POLICIES_DIR, false)
+	a.Nil(err)
+	written, err := readPolicyFile(config, policyFile)
+	a.Nil(err)
+	a.Equal(data.SignedPolicyData.Modified.String(), written.SignedPolicyData.Modified.String())
+	a.Equal(util.Exists(TEMP_POLICIES_DIR+"/verify1.bak"), false)
+}
+
+func TestVerifyAfterWriteRemovesNewFile(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("verify2", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"verify2": data})
+	defer server.Close()
+	removePolicyFiles("verify2")
+
+	config := getServerConfiguration(server, "verify2")
+	config.VerifyAfterWrite = true
+	restore := corruptWrittenPolicyFiles()
+	result, err := UpdatePolicies(config)
+	restore()
+	a.NotNil(err)
+	a.Equal([]string{"verify2"}, result.FailedDomains)
+	a.Equal(util.Exists(POLICIES_DIR+"/verify2.pol"), false)
+}
+
+func TestVerifyAfterWriteBatch(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("verify3", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	config := getSigningConfiguration()
+	config.VerifyAfterWrite = true
+	defer removePolicyFiles("verify3")
+
+	batch := &fsyncBatch{}
+	a.Nil(batch.stage(config, data, "verify3", POLICIES_DIR, false, ""))
+	restore := corruptWrittenPolicyFiles()
+	errs := batch.commit(config, zmsClientForTest())
+	restore()
+	a.NotNil(errs["verify3"])
+	_, err = os.Stat(POLICIES_DIR + "/verify3.pol")
+	a.True(os.IsNotExist(err))
+
+	batch = &fsyncBatch{}
+	a.Nil(batch.stage(config, data, "verify3", POLICIES_DIR, false, ""))
+	errs = batch.commit(config, zmsClientForTest())
+	a.Equal(0, len(errs))
+	a.Equal(util.Exists(POLICIES_DIR+"/verify3.pol"), true)
+}
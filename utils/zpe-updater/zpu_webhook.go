@@ -0,0 +1,60 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	RUN_RESULT_WEBHOOK_ATTEMPTS = 3
+	RUN_RESULT_WEBHOOK_BACKOFF  = time.Second
+	RUN_RESULT_WEBHOOK_TIMEOUT  = 10 * time.Second
+)
+
+// postRunResult posts the result of the run as json to the RunResultWebhook,
+// retrying network errors and server errors. Failures are logged only.
+func postRunResult(config *ZpuConfiguration, result *UpdateResult) {
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Unable to encode the run result, Error:%v", err)
+		return
+	}
+	client := &http.Client{Timeout: RUN_RESULT_WEBHOOK_TIMEOUT}
+	for attempt := 1; attempt <= RUN_RESULT_WEBHOOK_ATTEMPTS; attempt++ {
+		retry, err := postRunResultAttempt(client, config.RunResultWebhook, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == RUN_RESULT_WEBHOOK_ATTEMPTS {
+			log.Printf("Unable to post the run result to %v, Error:%v", config.RunResultWebhook, err)
+			return
+		}
+		log.Printf("Attempt %v to post the run result failed, Error:%v", attempt, err)
+		config.GetClock().Sleep(time.Duration(attempt) * RUN_RESULT_WEBHOOK_BACKOFF)
+	}
+}
+
+// postRunResultAttempt posts the result once and reports whether a failure
+// may succeed when retried
+func postRunResultAttempt(client *http.Client, url string, body []byte) (bool, error) {
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("Unexpected status: %v", resp.Status)
+}
@@ -0,0 +1,77 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+)
+
+func TestRunResultWebhook(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("webhook", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"webhook": data})
+	defer server.Close()
+	defer removePolicyFiles("webhook")
+	removePolicyFiles("webhook")
+
+	var mutex sync.Mutex
+	attempts := 0
+	var delivered *UpdateResult
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered = &UpdateResult{}
+		json.NewDecoder(r.Body).Decode(delivered)
+	}))
+	defer webhook.Close()
+
+	clock := newFakeClock(now)
+	config := getServerConfiguration(server, "webhook")
+	config.RunResultWebhook = webhook.URL
+	config.Clock = clock
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	a.Equal(2, attempts, "The result is delivered after a retry")
+	require.NotNil(t, delivered)
+	a.Equal([]string{"webhook"}, delivered.UpdatedDomains)
+	a.Equal(now.Add(RUN_RESULT_WEBHOOK_BACKOFF), clock.Now(), "The retry waits on the clock of the configuration")
+}
+
+func TestRunResultWebhookFailure(t *testing.T) {
+	a := assert.New(t)
+	var mutex sync.Mutex
+	attempts := 0
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempts++
+		mutex.Unlock()
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer webhook.Close()
+
+	config := &ZpuConfiguration{RunResultWebhook: webhook.URL, Clock: newFakeClock(time.Now())}
+	postRunResult(config, &UpdateResult{})
+	mutex.Lock()
+	defer mutex.Unlock()
+	a.Equal(1, attempts, "Client errors are not retried")
+}
@@ -0,0 +1,90 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+// NonWritableDirsError is returned before a run writes anything when some
+// of the configured output directories cannot be written, as happens with
+// a read-only root filesystem whose output directories are not mounted on
+// writable volumes
+type NonWritableDirsError struct {
+	// Dirs describes every non-writable directory with the probe error
+	Dirs []string
+}
+
+func (e *NonWritableDirsError) Error() string {
+	return fmt.Sprintf("Output directories are not writable, mount them on writable volumes: %v", strings.Join(e.Dirs, ", "))
+}
+
+// createProbeFile creates an empty file in the directory, tests replace it
+// to simulate a read-only filesystem
+var createProbeFile = func(dir string) (*os.File, error) {
+	return ioutil.TempFile(dir, ".zpu_writable_probe")
+}
+
+// VerifyWritableDirs probes every directory the configuration writes to:
+// the policy and temporary policy directories, the PolicyFileDirs, the
+// MetricsDir whose posted files are deleted, the OpaDataDir and the
+// directory of the PrometheusTextfile. A directory that does not exist yet
+// is probed through its closest existing parent, it is created there. A
+// missing MetricsDir is never written and is not probed.
+func VerifyWritableDirs(config *ZpuConfiguration) error {
+	dirs := []string{config.policyDir(), config.tmpPolicyDir()}
+	dirs = append(dirs, config.fanOutDirs()...)
+	if config.MetricsDir != "" && util.Exists(config.MetricsDir) {
+		dirs = append(dirs, config.MetricsDir)
+	}
+	if config.OpaDataDir != "" {
+		dirs = append(dirs, config.opaDataDir())
+	}
+	if config.PrometheusTextfile != "" {
+		dirs = append(dirs, filepath.Dir(config.PrometheusTextfile))
+	}
+	var nonWritable []string
+	probed := make(map[string]bool)
+	for _, dir := range dirs {
+		if dir == "" || probed[dir] {
+			continue
+		}
+		probed[dir] = true
+		err := probeWritable(existingDir(dir))
+		if err != nil {
+			nonWritable = append(nonWritable, fmt.Sprintf("%v (%v)", dir, err))
+		}
+	}
+	if len(nonWritable) > 0 {
+		return &NonWritableDirsError{Dirs: nonWritable}
+	}
+	return nil
+}
+
+// existingDir returns the directory or its closest existing parent
+func existingDir(dir string) string {
+	for !util.Exists(dir) {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	return dir
+}
+
+func probeWritable(dir string) error {
+	file, err := createProbeFile(dir)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
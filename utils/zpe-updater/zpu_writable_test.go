@@ -0,0 +1,77 @@
+// Copyright 2017 Yahoo Holdings, Inc.
+// Licensed under the terms of the Apache version 2.0 license. See LICENSE file for terms.
+
+package zpu
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yahoo/athenz/clients/go/zts"
+	"github.com/yahoo/athenz/utils/zpe-updater/util"
+)
+
+func TestVerifyWritableDirs(t *testing.T) {
+	a := assert.New(t)
+	now := time.Now()
+	data, err := signPolicyData("readonlyfs", now, now.Add(time.Hour))
+	require.Nil(t, err)
+	server := startPolicyServer(map[string]*zts.DomainSignedPolicyData{"readonlyfs": data})
+	defer server.Close()
+	defer removePolicyFiles("readonlyfs")
+	removePolicyFiles("readonlyfs")
+	readOnlyDir, err := ioutil.TempDir("", "zpu_readonly")
+	require.Nil(t, err)
+	defer os.RemoveAll(readOnlyDir)
+
+	//the read-only root filesystem rejects every file creation under it
+	defer func(create func(string) (*os.File, error)) { createProbeFile = create }(createProbeFile)
+	createProbeFile = func(dir string) (*os.File, error) {
+		if strings.HasPrefix(dir, readOnlyDir) {
+			return nil, &os.PathError{Op: "open", Path: dir + "/.zpu_writable_probe", Err: syscall.EROFS}
+		}
+		return ioutil.TempFile(dir, ".zpu_writable_probe")
+	}
+	config := getServerConfiguration(server, "readonlyfs")
+	a.Nil(VerifyWritableDirs(config))
+	config.OpaDataDir = readOnlyDir + "/opa/data"
+	config.PrometheusTextfile = readOnlyDir + "/zpu.prom"
+	result, err := UpdatePolicies(config)
+	a.Nil(result)
+	var writableErr *NonWritableDirsError
+	require.True(t, errors.As(err, &writableErr))
+	a.Equal([]string{
+		readOnlyDir + "/opa/data (open " + readOnlyDir + "/.zpu_writable_probe: read-only file system)",
+		readOnlyDir + " (open " + readOnlyDir + "/.zpu_writable_probe: read-only file system)",
+	}, writableErr.Dirs, "Both directories are listed, the missing one probed through its parent")
+	a.True(strings.Contains(err.Error(), "mount them on writable volumes"))
+	a.Empty(server.RequestedDomains(), "The run fails before fetching any policies")
+	a.False(util.Exists(POLICIES_DIR + "/readonlyfs.pol"))
+	a.False(util.Exists(readOnlyDir+"/opa"), "The missing directory is not created")
+
+	//the directories are probed before the environment directories are
+	//created and the write strategy is probed
+	config.OpaDataDir = ""
+	config.PrometheusTextfile = ""
+	config.Environment = "staging"
+	config.PolicyFileDirs = []string{readOnlyDir + "/fanout"}
+	config.WriteStrategy = WRITE_STRATEGY_HARDLINK
+	_, err = UpdatePolicies(config)
+	require.True(t, errors.As(err, &writableErr))
+	a.Equal(1, len(writableErr.Dirs))
+	a.False(util.Exists(readOnlyDir+"/fanout"), "The fan-out directory is not created")
+	a.False(util.Exists(POLICIES_DIR+"/staging"), "The policy directory is not created")
+
+	config.Environment = ""
+	config.PolicyFileDirs = nil
+	config.WriteStrategy = ""
+	_, err = UpdatePolicies(config)
+	a.Nil(err)
+}